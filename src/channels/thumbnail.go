@@ -1,15 +1,89 @@
 package main
 
-import "log"
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"go-practice/src/lifecycle"
+	"go-practice/src/progress"
+	"go-practice/src/thumbnail"
+)
+
+// 为目录中的图片批量生成缩略图:
+//
+//	go run thumbnail.go -workers 8 -size 200 catalogue/shoes catalogue/hats/a.jpg
+//
+// 参数可以是图片文件或者目录(不递归)，缩略图写在原图旁边，比如 a.jpg -> a.thumb.jpg。
+// Ctrl-C以后不再开始新的图片，等正在处理的图片完成后退出。
+
+var (
+	workers = flag.Int("workers", runtime.NumCPU(), "images processed at the same time")
+	size    = flag.Int("size", thumbnail.DefaultSize, "maximum width and height of a thumbnail")
+)
+
+func main() {
+	flag.Parse()
+	if *workers <= 0 || *size <= 0 {
+		log.Fatal("-workers and -size must be positive")
+	}
+	filenames, err := expand(flag.Args())
+	if err != nil {
+		log.Fatal(err)
+	}
+	lc := lifecycle.New(0)
+	bar := progress.NewBar("thumbnails", int64(len(filenames))).Start(lc.Context())
+	files, total, err := makeThumbnails(lc.Context(), filenames, *workers, bar)
+	bar.Stop()
+	log.Printf("wrote %d thumbnails, %d bytes", len(files), total)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// expand 把参数中的目录展开成其中的图片文件，跳过已经生成的缩略图
+func expand(args []string) ([]string, error) {
+	var filenames []string
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			filenames = append(filenames, arg)
+			continue
+		}
+		infos, err := ioutil.ReadDir(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range infos {
+			switch strings.ToLower(filepath.Ext(fi.Name())) {
+			case ".jpg", ".jpeg", ".png", ".gif":
+				if fi.Mode().IsRegular() && !thumbnail.IsThumbnail(fi.Name()) {
+					filenames = append(filenames, filepath.Join(arg, fi.Name()))
+				}
+			}
+		}
+	}
+	return filenames, nil
+}
 
 // imageFile reads an image from infile and writes a thumbnail-size version of it in the same directory
-func imageFile(infile string)(string, error){
-	//	TODO
-	return "", nil
+func imageFile(infile string) (string, error) {
+	name, _, err := thumbnail.File(context.Background(), infile, thumbnail.DefaultSize)
+	return name, err
 }
 
 // 循环迭代一些图片文件名，并为每一张图片生成一个缩略图
-func makeThumbnails(filenames []string){
+func makeThumbnails1(filenames []string) {
 	for _, f := range filenames {
 		if _, err := imageFile(f); err != nil {
 			log.Println(err)
@@ -18,16 +92,16 @@ func makeThumbnails(filenames []string){
 }
 
 // 错误的协程并发方式，函数未等到其他协程执行结束就返回了
-func makeThumbnails2(filenames []string){
-	for _, f := range filenames{
+func makeThumbnails2(filenames []string) {
+	for _, f := range filenames {
 		go imageFile(f)
 	}
 }
 
 // 没有直接的方法能够等待goroutine执行完成，但可以通过channel发送事件的方式向外部调用协程报告完成情况
-func makeThumbnails3(filenames []string){
+func makeThumbnails3(filenames []string) {
 	ch := make(chan struct{})
-	for _, f:= range filenames{
+	for _, f := range filenames {
 		// 将f的值作为一个显式的变量传给了函数，而不是在循环的闭包中声明
 		// 当新的goroutine开始执行匿名函数时，for循环可能已经更新了f并且开始了另一轮的迭代或者已经结束了整个循环，
 		// 所以当这些goroutine开始读取f的值时，它们所看到的值可能是slice迭代之后的元素或者最后一个元素了
@@ -39,7 +113,7 @@ func makeThumbnails3(filenames []string){
 
 	// wait for goroutines to complete
 	for range filenames {
-		<- ch
+		<-ch
 	}
 }
 
@@ -56,8 +130,8 @@ func makeThubnails4(filenames []string) error {
 	// incorrect
 	// 当它遇到第一个非nil的error时会直接将error返回到调用方，使得没有一个goroutine去清空errors channel。
 	// 这样剩下的worker goroutine在向这个channel中发送值时，都会永远地阻塞下去
-	for range filenames{
-		if err := <- errors; err != nil {
+	for range filenames {
+		if err := <-errors; err != nil {
 			return err
 		}
 	}
@@ -66,4 +140,84 @@ func makeThubnails4(filenames []string) error {
 }
 
 // 最简单的解决办法就是用一个具有合适大小的buffered channel
-// ch := make(chan item, len(filenames))
\ No newline at end of file
+// ch := make(chan item, len(filenames))
+
+// thumbErrors 是处理多个文件时出的所有错误
+type thumbErrors []error
+
+func (e thumbErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return fmt.Sprintf("%d errors:\n  %s", len(e), strings.Join(s, "\n  "))
+}
+
+// makeThumbnails 用固定个数的worker生成缩略图，不会因为文件太多同时打开太多文件、占用太多内存。
+// 所有worker都从jobs中取文件名，把结果发到results，由调用者的goroutine统一收集，
+// 所以出错时不会像makeThubnails4那样有goroutine阻塞在发送上，也不会遗漏后面的错误。
+// ctx取消以后不再开始新的文件，返回已经生成的文件和ctx.Err()
+func makeThumbnails(ctx context.Context, filenames []string, workers int, bar *progress.Bar) ([]string, int64, error) {
+	type item struct {
+		name string
+		size int64
+		err  error
+	}
+	jobs := make(chan string)
+	results := make(chan item)
+
+	go func() {
+		defer close(jobs)
+		for _, f := range filenames {
+			select {
+			case jobs <- f:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range jobs {
+				name, n, err := thumbnail.File(ctx, f, *size)
+				results <- item{name, n, err}
+			}
+		}()
+	}
+	// closer
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var (
+		files []string
+		total int64
+		errs  thumbErrors
+	)
+	for it := range results {
+		bar.Add(1)
+		if it.err != nil {
+			if it.err != ctx.Err() {
+				errs = append(errs, it.err)
+			}
+			continue
+		}
+		files = append(files, it.name)
+		total += it.size
+	}
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	switch len(errs) {
+	case 0:
+		return files, total, nil
+	case 1:
+		return files, total, errs[0]
+	}
+	return files, total, errs
+}
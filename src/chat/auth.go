@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 指定 -users 后客户端需要先登录，登录的用户名就是昵称。用户文件每行一个凭据，一个用户可以有多行:
+//
+//	# name     credential
+//	alice      pbkdf2-sha256$100000$<salt>$<hash>
+//	deploybot  token-sha256$<hex>
+//
+// 凭据用 chat -hash-password (从标准输入读密码) 和 chat -new-token 生成。文件修改后下一次登录时自动重新加载。
+// TCP和WebSocket客户端发送一行 "<name> <password>" 或 "token <token>" 登录，
+// HTTP会话用 Authorization: Bearer <token> 或者Basic认证。
+// 同一个IP连续登录失败 -auth-failures 次以后在 -auth-lockout 时间内拒绝登录，之后每失败一次时间加倍。
+
+const (
+	pbkdf2Prefix     = "pbkdf2-sha256$"
+	tokenPrefix      = "token-sha256$"
+	pbkdf2Iterations = 100000
+	maxLoginAttempts = 3 // 每个连接最多尝试的次数
+)
+
+var (
+	errLoginFailed = errors.New("invalid name, password or token")
+	errLockedOut   = errors.New("too many failed logins")
+
+	// dummyCredential 用来校验不存在的用户，使其和已有用户花同样的时间，不能通过响应时间猜出用户名。
+	// 全零的salt和hash，任何密码都不会匹配
+	dummyCredential = fmt.Sprintf("%s%d$%s$%s", pbkdf2Prefix, pbkdf2Iterations, strings.Repeat("A", 22), strings.Repeat("A", 43))
+)
+
+type authenticator struct {
+	path string
+
+	mu        sync.Mutex
+	modTime   time.Time
+	passwords map[string][]string // name -> pbkdf2凭据
+	tokens    map[string]string   // token的SHA-256 -> name
+}
+
+func newAuthenticator(path string) (*authenticator, error) {
+	a := &authenticator{path: path}
+	if err := a.reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reload 在文件修改过时重新加载
+func (a *authenticator) reload() error {
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(a.modTime) && a.passwords != nil {
+		return nil
+	}
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	passwords := make(map[string][]string)
+	tokens := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 || !validName.MatchString(fields[0]) {
+			return fmt.Errorf("%s:%d: want <name> <credential>", a.path, n)
+		}
+		name, cred := fields[0], fields[1]
+		switch {
+		case strings.HasPrefix(cred, pbkdf2Prefix):
+			passwords[name] = append(passwords[name], cred)
+		case strings.HasPrefix(cred, tokenPrefix):
+			tokens[strings.ToLower(strings.TrimPrefix(cred, tokenPrefix))] = name
+		default:
+			return fmt.Errorf("%s:%d: unknown credential type", a.path, n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	a.modTime, a.passwords, a.tokens = info.ModTime(), passwords, tokens
+	return nil
+}
+
+// password 校验用户名和密码，返回用户名
+func (a *authenticator) password(name, password string) (string, error) {
+	a.mu.Lock()
+	if err := a.reload(); err != nil {
+		log.Printf("users file: %v", err)
+	}
+	creds := a.passwords[name]
+	a.mu.Unlock()
+	if len(creds) == 0 {
+		checkPassword(dummyCredential, password)
+		return "", errLoginFailed
+	}
+	for _, cred := range creds {
+		if checkPassword(cred, password) {
+			return name, nil
+		}
+	}
+	return "", errLoginFailed
+}
+
+// token 校验bearer token，返回token所属的用户名
+func (a *authenticator) token(token string) (string, error) {
+	sum := sha256.Sum256([]byte(token))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.reload(); err != nil {
+		log.Printf("users file: %v", err)
+	}
+	if name, ok := a.tokens[hex.EncodeToString(sum[:])]; ok {
+		return name, nil
+	}
+	return "", errLoginFailed
+}
+
+// line 校验TCP和WebSocket客户端发送的登录行
+func (a *authenticator) line(line string) (string, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return "", errLoginFailed
+	}
+	if fields[0] == "token" {
+		return a.token(fields[1])
+	}
+	return a.password(fields[0], fields[1])
+}
+
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := pbkdf2([]byte(password), salt, pbkdf2Iterations)
+	return fmt.Sprintf("%s%d$%s$%s", pbkdf2Prefix, pbkdf2Iterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func checkPassword(cred, password string) bool {
+	parts := strings.Split(strings.TrimPrefix(cred, pbkdf2Prefix), "$")
+	if len(parts) != 3 {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[0])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err1 := base64.RawStdEncoding.DecodeString(parts[1])
+	want, err2 := base64.RawStdEncoding.DecodeString(parts[2])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2([]byte(password), salt, iter), want) == 1
+}
+
+// pbkdf2 是只输出一个块(32字节)的PBKDF2-HMAC-SHA256
+func pbkdf2(password, salt []byte, iter int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var block [4]byte
+	binary.BigEndian.PutUint32(block[:], 1)
+	prf.Write(salt)
+	prf.Write(block[:])
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iter; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+func newToken() (token, cred string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	sum := sha256.Sum256([]byte(token))
+	return token, tokenPrefix + hex.EncodeToString(sum[:]), nil
+}
+
+// loginLimiter 按IP限制登录失败的次数
+type loginLimiter struct {
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+}
+
+type loginFailures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+var logins = &loginLimiter{failures: make(map[string]*loginFailures)}
+
+// wait 返回还需要等待多久才能再次尝试登录
+func (l *loginLimiter) wait(ip string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.failures[ip]; ok {
+		return time.Until(f.until)
+	}
+	return 0
+}
+
+func (l *loginLimiter) fail(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	f, ok := l.failures[ip]
+	// 一段时间没有失败以后重新计数
+	if !ok || now.Sub(f.last) > *authLockout*4 {
+		f = &loginFailures{}
+		l.failures[ip] = f
+	}
+	f.count++
+	f.last = now
+	if n := f.count - *authFailures; n >= 0 {
+		if n > 10 {
+			n = 10
+		}
+		f.until = now.Add(*authLockout << uint(n))
+	}
+	// 顺便清理过期的记录，避免map无限增长
+	for other, of := range l.failures {
+		if now.Sub(of.last) > *authLockout*4 && now.After(of.until) {
+			delete(l.failures, other)
+		}
+	}
+}
+
+func (l *loginLimiter) succeed(ip string) {
+	l.mu.Lock()
+	delete(l.failures, ip)
+	l.mu.Unlock()
+}
+
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,130 @@
+package main
+
+import "sync"
+
+// bus 在集群的节点之间转发事件。每个房间仍然只有一个broadcaster，
+// 但它只负责本节点的成员，其它节点的成员由各自节点的broadcaster发送，广播的负载分摊到所有节点。
+// 同一个事件可能经过不同的连接到达多次，接收方按ID去重。
+type bus interface {
+	// Publish 把事件发给其它节点，不能阻塞
+	Publish(e busEvent)
+	// Events 返回其它节点发来的事件，以及节点连接上(evUp)和断开(evDown)的通知
+	Events() <-chan busEvent
+	Close() error
+}
+
+// 事件类型
+const (
+	evMessage  = "message"  // 房间消息
+	evJoin     = "join"     // 加入房间，Msg是 "has arrived"
+	evLeave    = "leave"    // 离开房间，Msg是 "has left"
+	evRename   = "rename"   // 改名，Nick是旧昵称，To是新昵称
+	evPrivate  = "private"  // 私信，Nick发给To
+	evOnline   = "online"   // Nick登录了
+	evOffline  = "offline"  // Nick断开了
+	evSync     = "sync"     // 节点上所有房间的成员和所有在线用户
+	evModerate = "moderate" // 管理操作
+	evUp       = "up"       // 只在本节点内部使用
+	evDown     = "down"
+)
+
+type busEvent struct {
+	ID    string              `json:"id"`
+	Node  string              `json:"node"`
+	Type  string              `json:"type"`
+	Room  string              `json:"room,omitempty"`
+	Nick  string              `json:"nick,omitempty"`
+	To    string              `json:"to,omitempty"`
+	Text  string              `json:"text,omitempty"`
+	Msg   *message            `json:"msg,omitempty"`
+	Rooms map[string][]string `json:"rooms,omitempty"`
+	Users []string            `json:"users,omitempty"`
+	Mod   *modAction          `json:"mod,omitempty"`
+}
+
+// memHub 是进程内的bus，挂在同一个hub上的节点互相转发事件。
+// 不组成集群时chat使用只有一个节点的hub
+type memHub struct {
+	mu    sync.Mutex
+	nodes []*memBus
+}
+
+type memBus struct {
+	hub    *memHub
+	node   string
+	events chan busEvent
+}
+
+func (h *memHub) join(node string) *memBus {
+	b := &memBus{hub: h, node: node, events: make(chan busEvent, 1024)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, other := range h.nodes {
+		other.send(busEvent{Type: evUp, Node: node})
+		b.send(busEvent{Type: evUp, Node: other.node})
+	}
+	h.nodes = append(h.nodes, b)
+	return b
+}
+
+func (b *memBus) Publish(e busEvent) {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+	for _, other := range b.hub.nodes {
+		if other != b {
+			other.send(e)
+		}
+	}
+}
+
+// send 不等待接收方。和TCP连接一样，跟不上的节点丢掉事件，靠定期的sync恢复成员列表
+func (b *memBus) send(e busEvent) {
+	select {
+	case b.events <- e:
+	default:
+	}
+}
+
+func (b *memBus) Events() <-chan busEvent {
+	return b.events
+}
+
+func (b *memBus) Close() error {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+	for i, other := range b.hub.nodes {
+		if other == b {
+			b.hub.nodes = append(b.hub.nodes[:i], b.hub.nodes[i+1:]...)
+			break
+		}
+	}
+	for _, other := range b.hub.nodes {
+		other.send(busEvent{Type: evDown, Node: b.node})
+	}
+	return nil
+}
+
+// recentIDs 记录最近见过的事件ID，用于去重
+type recentIDs struct {
+	seen map[string]bool
+	ring []string
+	next int
+}
+
+func newRecentIDs(n int) *recentIDs {
+	return &recentIDs{seen: make(map[string]bool, n), ring: make([]string, n)}
+}
+
+// add 记录id，已经见过时返回false
+func (r *recentIDs) add(id string) bool {
+	if r.seen[id] {
+		return false
+	}
+	if old := r.ring[r.next]; old != "" {
+		delete(r.seen, old)
+	}
+	r.ring[r.next] = id
+	r.next = (r.next + 1) % len(r.ring)
+	r.seen[id] = true
+	return true
+}
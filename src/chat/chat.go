@@ -0,0 +1,310 @@
+// Copyright 2019 didi. All rights reserved.
+// Created by hexiaomin on 2019/3/18.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go-practice/src/lifecycle"
+)
+
+// chat 是一个按房间广播的聊天服务器，用nc之类的工具就可以连接:
+//
+//	nc localhost 8000
+//
+// 连接后先输入昵称，之后输入的每一行发送到当前房间，以/开头的行是命令，/help 查看所有命令。
+// 机器人可以用 /format json 切换到JSON frame，见framing.go。
+// 每个房间有自己的broadcaster goroutine，通过entering、leaving、messages三个channel维护成员和广播消息。
+// 指定 -http 后浏览器和脚本可以通过WebSocket、SSE或长轮询加入同样的房间，见gateway.go。
+// 多个进程可以通过 -cluster 和 -peers 组成集群共享房间，见cluster.go。
+
+var (
+	addr     = flag.String("addr", "localhost:8000", "listen address")
+	lobby    = flag.String("lobby", "lobby", "room every user joins after choosing a nickname")
+	maxRooms = flag.Int("max-rooms", 32, "rooms a client may be in at the same time")
+	drain    = flag.Duration("drain", 5*time.Second, "time to wait for clients to be disconnected on shutdown")
+	health   = flag.String("health", "", "address for /healthz, /readyz and /debug/vars, empty to disable")
+
+	queueSize    = flag.Int("queue", 256, "outbound messages buffered per client")
+	overflow     = flag.String("overflow", dropOldest, "what to do when a client's queue is full: drop-oldest, drop-new or disconnect")
+	writeTimeout = flag.Duration("write-timeout", 10*time.Second, "disconnect clients whose writes stall for this long")
+
+	idleTimeout  = flag.Duration("idle", 0, "disconnect clients that send nothing for this long, 0 to disable")
+	idleWarning  = flag.Duration("idle-warning", time.Minute, "warn idle clients this long before disconnecting them")
+	pingInterval = flag.Duration("ping", 0, "send PING to clients quiet for this long, 0 to disable")
+	pingTimeout  = flag.Duration("ping-timeout", 30*time.Second, "disconnect clients that do not answer a PING within this time")
+
+	historyDir  = flag.String("history", "history", "directory for room message logs, empty to disable history")
+	replayLast  = flag.Int("replay", 20, "messages replayed when joining a room")
+	historyPage = flag.Int("history-page", 20, "messages per /history page")
+
+	httpAddr   = flag.String("http", "", "address of the WebSocket, SSE and long-poll gateway, empty to disable")
+	sessionTTL = flag.Duration("session-ttl", time.Minute, "end HTTP sessions that are not polled for this long")
+	originList = flag.String("ws-origins", "", "comma-separated origins such as https://chat.example.com allowed to open WebSockets besides the gateway's own host")
+
+	tlsCert       = flag.String("tls-cert", "", "TLS certificate file, enables TLS for the TCP listener and the gateway")
+	tlsKey        = flag.String("tls-key", "", "TLS private key file")
+	tlsSelfSigned = flag.Bool("tls-self-signed", false, "enable TLS with a generated self-signed certificate, for development")
+	usersFile     = flag.String("users", "", "file of names and credentials, clients must log in when set")
+	authFailures  = flag.Int("auth-failures", 5, "failed logins from one IP before it is locked out")
+	authLockout   = flag.Duration("auth-lockout", time.Minute, "how long an IP is locked out, doubled on every further failure")
+	hashPass      = flag.Bool("hash-password", false, "read a password from stdin, print its credential for the users file and exit")
+	genToken      = flag.Bool("new-token", false, "print a new bearer token and its credential for the users file and exit")
+
+	lineRate  = flag.Float64("rate", 5, "lines per second a client may send on average, 0 to disable the limit")
+	lineBurst = flag.Int("burst", 20, "lines a client may send at once")
+	floodKick = flag.Int("flood-kick", 100, "disconnect clients after this many lines in a row were dropped, 0 to never disconnect")
+	adminList = flag.String("admins", "", "comma-separated names allowed to /kick, /ban and /mute, use with -users")
+	bansFile  = flag.String("bans", "bans.json", "file the ban list is kept in, empty to keep it in memory")
+
+	nodeName      = flag.String("node", "", "name of this node in the cluster, random by default")
+	clusterAddr   = flag.String("cluster", "", "address to listen on for other cluster nodes, empty to run alone")
+	clusterPeers  = flag.String("peers", "", "comma-separated cluster addresses of the other nodes")
+	clusterSecret = flag.String("cluster-secret", "", "shared secret the cluster nodes must present, required with -cluster")
+
+	rooms *roomSet
+	auth  *authenticator // nil表示不需要登录
+)
+
+type client chan<- string // an outgoing message channel
+
+func main() {
+	flag.Parse()
+	if *hashPass || *genToken {
+		credentials()
+		return
+	}
+	switch *overflow {
+	case dropOldest, dropNew, disconnect:
+	default:
+		log.Fatalf("unknown -overflow %q", *overflow)
+	}
+	if *replayLast < 0 || *historyPage <= 0 {
+		log.Fatal("-replay must not be negative and -history-page must be positive")
+	}
+	if *clusterAddr != "" && *clusterSecret == "" {
+		log.Fatal("-cluster requires -cluster-secret")
+	}
+	cfg, err := tlsConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *usersFile != "" {
+		if auth, err = newAuthenticator(*usersFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if mod, err = loadModeration(*bansFile); err != nil {
+		log.Fatal(err)
+	}
+	admins = make(map[string]bool)
+	for _, name := range splitList(*adminList) {
+		admins[strings.ToLower(name)] = true
+	}
+	wsOrigins = make(map[string]bool)
+	for _, o := range splitList(*originList) {
+		wsOrigins[strings.ToLower(strings.TrimSuffix(o, "/"))] = true
+	}
+	if len(admins) > 0 && auth == nil {
+		log.Print("warning: -admins without -users, anyone can take an admin's name")
+	}
+	for _, a := range []string{*addr, *httpAddr} {
+		if a != "" && !isLoopback(a) && (cfg == nil || auth == nil) {
+			log.Printf("warning: %s is reachable from other hosts, use -tls-cert and -users", a)
+		}
+	}
+	lc := lifecycle.New(*drain)
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg != nil {
+		listener = tls.NewListener(listener, cfg)
+	}
+	if *health != "" {
+		// expvar把丢弃消息和断开客户端的计数注册在 /debug/vars
+		lc.RegisterHealth(http.DefaultServeMux)
+		go func() {
+			log.Printf("health: %v", http.ListenAndServe(*health, nil))
+		}()
+	}
+	rooms = newRoomSet(*historyDir)
+	node := *nodeName
+	if node == "" {
+		node = idPrefix
+	}
+	var b bus
+	if *clusterAddr != "" {
+		if b, err = newMeshBus(node, *clusterAddr, splitList(*clusterPeers), *clusterSecret); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		b = new(memHub).join(node)
+	}
+	cluster = newCluster(node, b)
+	go cluster.run()
+	go func() {
+		<-lc.Context().Done()
+		users.notifyAll("server is shutting down")
+	}()
+	gwDone := make(chan struct{})
+	if *httpAddr != "" {
+		go func() {
+			err := lc.ListenAndServe(&http.Server{Addr: *httpAddr, Handler: gateway(lc.Context()), TLSConfig: cfg})
+			if err != nil && err != lifecycle.ErrDrainTimeout {
+				log.Fatal(err)
+			}
+			wsConns.Wait()
+			close(gwDone)
+		}()
+	} else {
+		close(gwDone)
+	}
+	if err := lc.Serve(listener, handleConn); err != nil {
+		log.Fatal(err)
+	}
+	<-gwDone
+	b.Close()
+}
+
+// handleConn为每一个客户端创建了一个clientWriter的goroutine来接收向客户端发出消息channel中发送的广播消息，并将它们写入到客户端的网络连接
+// 两者之间由queue goroutine缓冲，慢客户端不会阻塞发送方。
+// 退出时停止读取，连接按正常离开的流程关闭。
+func handleConn(ctx context.Context, conn net.Conn) {
+	ev := &evictor{addr: conn.RemoteAddr().String(), c: conn}
+	f := &framer{}
+	ch := make(chan string) // outgoing client messages
+	out := make(chan string)
+	go queue(ch, out, ev, f)
+	written := make(chan struct{})
+	go func() {
+		clientWriter(conn, out, ev)
+		close(written)
+	}()
+	m := newMonitor(conn, ch, f)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		m.run(ctx, done)
+		close(stopped)
+	}()
+
+	input := &lineReader{Scanner: bufio.NewScanner(conn), m: m}
+	if u := handshake(conn.RemoteAddr().String(), ch, f, input); u != nil {
+		u.join(*lobby, replay{last: *replayLast})
+		for input.Scan() {
+			u.handle(input.Text())
+		}
+		// NOTE: ignoring potential errors from input.Err()
+		u.quit()
+	}
+	// 所有房间都已离开、用户已注销、monitor已退出，不会再有人往ch发送消息
+	close(done)
+	<-stopped
+	close(ch)
+	<-written
+	conn.Close()
+}
+
+// handshake 读取昵称并注册用户，连接在此之前断开时返回nil
+func handshake(remote string, ch chan<- string, f *framer, input *lineReader) *user {
+	if b, ok := mod.banned("", hostOf(remote)); ok {
+		ch <- f.notice(bannedError{b.Until}.Error())
+		return nil
+	}
+	u := newUser(remote, ch, f, input.m.disconnect)
+	if auth != nil {
+		return login(u, input)
+	}
+	ch <- f.notice("Enter your nickname:")
+	for input.Scan() {
+		err := users.register(u, input.Text())
+		if err == nil {
+			ch <- welcome(u)
+			return u
+		}
+		ch <- f.notice(err.Error() + ", try another one:")
+	}
+	return nil
+}
+
+func welcome(u *user) string {
+	return u.f.encode(frame{Type: frameWelcome, From: u.nick, Text: "You are " + u.nick + ", type /help for commands"})
+}
+
+// login 要求客户端先登录，用户名作为昵称。登录失败过多时断开连接
+func login(u *user, input *lineReader) *user {
+	ip := hostOf(u.addr)
+	ch, f := u.out, u.f
+	ch <- f.notice("Log in with \"<name> <password>\" or \"token <token>\":")
+	for attempt := 1; input.Scan(); attempt++ {
+		if wait := logins.wait(ip); wait > 0 {
+			ch <- f.notice(fmt.Sprintf("%v, try again in %v", errLockedOut, wait.Round(time.Second)))
+			return nil
+		}
+		name, err := auth.line(input.Text())
+		if err != nil {
+			logins.fail(ip)
+			log.Printf("login from %s failed", u.addr)
+			// 拖慢暴力尝试
+			time.Sleep(time.Second)
+			if attempt >= maxLoginAttempts {
+				ch <- f.notice(err.Error() + ", disconnecting")
+				return nil
+			}
+			ch <- f.notice(err.Error() + ", try again:")
+			continue
+		}
+		logins.succeed(ip)
+		if err := users.register(u, name); err != nil {
+			ch <- f.notice(fmt.Sprintf("%s: %v", name, err))
+			return nil
+		}
+		ch <- welcome(u)
+		return u
+	}
+	return nil
+}
+
+// splitList 解析逗号分隔的列表，忽略空项
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// credentials 生成用户文件中的凭据
+func credentials() {
+	if *genToken {
+		token, cred, err := newToken()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("token:      %s\ncredential: %s\n", token, cred)
+		return
+	}
+	input := bufio.NewScanner(os.Stdin)
+	if !input.Scan() {
+		log.Fatal("no password on stdin")
+	}
+	cred, err := hashPassword(input.Text())
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(cred)
+}
@@ -0,0 +1,371 @@
+// Package client 是聊天服务器JSON协议的客户端，连接断开以后自动重连:
+//
+//	c, err := client.Dial(client.Config{Addr: "localhost:8000", Nick: "echobot", Rooms: []string{"ops"}})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer c.Close()
+//	for f := range c.Frames() {
+//		if f.Type == client.Message && !f.History && f.From != c.Nick() {
+//			c.Say(f.Room, f.From+" said "+f.Text)
+//		}
+//	}
+//
+// 重连以后重新登录、加入之前的房间，并请求断开期间错过的历史消息，已经收到过的消息按id去掉。
+// 每次连接成功都会收到一个Welcome frame。
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Frame 的类型
+const (
+	Message = "message" // 房间里用户发送的消息
+	Event   = "event"   // 房间里的系统事件: 加入、离开、改名
+	Private = "private" // 私信
+	Notice  = "notice"  // 只发给这个客户端的提示、命令的输出和错误
+	Welcome = "welcome" // 登录成功，From是分配到的昵称
+	Ping    = "ping"    // 心跳，客户端自动回应，不会出现在Frames中
+
+	pong    = "pong"
+	command = "command"
+	login   = "login"
+)
+
+var (
+	ErrClosed       = errors.New("client: closed")
+	ErrNotConnected = errors.New("client: not connected")
+)
+
+// Frame 是协议中的一行
+type Frame struct {
+	Type    string    `json:"type"`
+	ID      string    `json:"id,omitempty"`
+	Room    string    `json:"room,omitempty"`
+	From    string    `json:"from,omitempty"`
+	Text    string    `json:"text"`
+	Time    time.Time `json:"timestamp"`
+	History bool      `json:"history,omitempty"` // 加入房间时回放的历史消息
+}
+
+type Config struct {
+	Addr  string
+	TLS   *tls.Config // 不为空时使用TLS连接
+	Nick  string
+	Login string   // 服务器要求登录时使用，"<name> <password>" 或 "token <token>"，优先于Nick
+	Rooms []string // 连接以后加入的房间，服务器总是会先加入大厅
+
+	DialTimeout time.Duration // 默认10s，同时也是登录和每次写的超时
+	MinBackoff  time.Duration // 重连的间隔从MinBackoff开始加倍到MaxBackoff，默认1s和30s
+	MaxBackoff  time.Duration
+}
+
+const (
+	frameBuffer = 64
+	seenIDs     = 1024 // 用来去重的最近的消息id个数
+)
+
+type Client struct {
+	cfg    Config
+	frames chan Frame
+	done   chan struct{}
+	once   sync.Once
+
+	mu    sync.Mutex
+	conn  net.Conn // 断开期间为nil
+	nick  string
+	rooms map[string]bool
+	last  time.Time // 收到的最后一条房间消息的时间，重连时从这里开始回放
+
+	seen  map[string]bool // 只由run goroutine访问
+	order []string
+}
+
+// Dial 连接并登录，第一次连接失败时返回错误，之后的断开会在后台重连
+func Dial(cfg Config) (*Client, error) {
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 10 * time.Second
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	c := &Client{
+		cfg:    cfg,
+		frames: make(chan Frame, frameBuffer),
+		done:   make(chan struct{}),
+		rooms:  make(map[string]bool),
+		seen:   make(map[string]bool),
+	}
+	for _, room := range cfg.Rooms {
+		c.rooms[room] = true
+	}
+	input, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	go c.run(input)
+	return c, nil
+}
+
+// Frames 返回收到的frame，Close以后被关闭。不及时读取会阻塞接收
+func (c *Client) Frames() <-chan Frame {
+	return c.frames
+}
+
+// Nick 返回服务器分配的昵称
+func (c *Client) Nick() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nick
+}
+
+// Say 发送一条消息到已经加入的房间，room为空时发到当前房间
+func (c *Client) Say(room, text string) error {
+	return c.send(Frame{Type: Message, Room: room, Text: text})
+}
+
+// Msg 发送私信
+func (c *Client) Msg(nick, text string) error {
+	return c.Command("/msg " + nick + " " + text)
+}
+
+// Join 加入房间，重连以后会重新加入
+func (c *Client) Join(room string) error {
+	c.mu.Lock()
+	c.rooms[room] = true
+	c.mu.Unlock()
+	return c.Command("/join " + room)
+}
+
+func (c *Client) Leave(room string) error {
+	c.mu.Lock()
+	delete(c.rooms, room)
+	c.mu.Unlock()
+	return c.Command("/leave " + room)
+}
+
+// Command 发送一个以/开头的命令，结果以Notice frame返回
+func (c *Client) Command(line string) error {
+	return c.send(Frame{Type: command, Text: line})
+}
+
+// Close 断开连接并停止重连
+func (c *Client) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *Client) send(f Frame) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.write(b)
+}
+
+// write 写一行，调用时持有c.mu
+func (c *Client) write(b []byte) error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.cfg.DialTimeout))
+	_, err := c.conn.Write(append(b, '\n'))
+	return err
+}
+
+// connect 建立连接，切换到JSON模式，登录并加入房间
+func (c *Client) connect() (*bufio.Scanner, error) {
+	dialer := &net.Dialer{Timeout: c.cfg.DialTimeout}
+	var conn net.Conn
+	var err error
+	if c.cfg.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.cfg.Addr, c.cfg.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", c.cfg.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	input := bufio.NewScanner(conn)
+	input.Buffer(make([]byte, 4096), 1<<20)
+	conn.SetDeadline(time.Now().Add(c.cfg.DialTimeout))
+	nick, err := c.login(conn, input)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		conn.Close()
+		return nil, ErrClosed
+	default:
+	}
+	c.conn, c.nick = conn, nick
+	for room := range c.rooms {
+		line := "/join " + room
+		if !c.last.IsZero() {
+			line += " " + c.last.Format(time.RFC3339Nano)
+		}
+		b, _ := json.Marshal(Frame{Type: command, Text: line})
+		if err := c.write(b); err != nil {
+			c.conn = nil
+			conn.Close()
+			return nil, err
+		}
+	}
+	return input, nil
+}
+
+// login 在握手期间读写，这时连接还只属于当前goroutine
+func (c *Client) login(conn net.Conn, input *bufio.Scanner) (string, error) {
+	if _, err := fmt.Fprintln(conn, "/format json"); err != nil {
+		return "", err
+	}
+	// 切换之前服务器发出的提示是文本，第一个JSON frame是切换格式的回复
+	if _, err := readFrame(input); err != nil {
+		return "", err
+	}
+	name := c.cfg.Nick
+	if c.cfg.Login != "" {
+		name = c.cfg.Login
+	}
+	b, _ := json.Marshal(Frame{Type: login, Text: name})
+	if _, err := conn.Write(append(b, '\n')); err != nil {
+		return "", err
+	}
+	f, err := readFrame(input)
+	if err != nil {
+		return "", err
+	}
+	if f.Type != Welcome {
+		return "", fmt.Errorf("client: login failed: %s", f.Text)
+	}
+	return f.From, c.deliver(f)
+}
+
+func readFrame(input *bufio.Scanner) (Frame, error) {
+	for input.Scan() {
+		line := input.Text()
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var f Frame
+		if err := json.Unmarshal([]byte(line), &f); err != nil {
+			return f, fmt.Errorf("client: bad frame: %v", err)
+		}
+		return f, nil
+	}
+	if err := input.Err(); err != nil {
+		return Frame{}, err
+	}
+	return Frame{}, errors.New("client: connection closed by server")
+}
+
+// run 读取frame直到连接断开，然后重连，直到Close
+func (c *Client) run(input *bufio.Scanner) {
+	defer close(c.frames)
+	for {
+		for {
+			f, err := readFrame(input)
+			if err != nil {
+				break
+			}
+			if f.Type == Ping {
+				c.send(Frame{Type: pong, Text: f.Text})
+				continue
+			}
+			if c.deliver(f) != nil {
+				break
+			}
+		}
+		c.mu.Lock()
+		if c.conn != nil {
+			c.conn.Close()
+			c.conn = nil
+		}
+		c.mu.Unlock()
+		input = c.reconnect()
+		if input == nil {
+			return
+		}
+	}
+}
+
+func (c *Client) reconnect() *bufio.Scanner {
+	backoff := c.cfg.MinBackoff
+	for {
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(backoff):
+		}
+		input, err := c.connect()
+		if err == nil {
+			return input
+		}
+		if err == ErrClosed {
+			return nil
+		}
+		if backoff *= 2; backoff > c.cfg.MaxBackoff {
+			backoff = c.cfg.MaxBackoff
+		}
+	}
+}
+
+// deliver 去掉重复的消息，记录房间消息的时间，把frame交给调用方
+func (c *Client) deliver(f Frame) error {
+	if f.ID != "" {
+		if c.seen[f.ID] {
+			return nil
+		}
+		c.seen[f.ID] = true
+		c.order = append(c.order, f.ID)
+		if len(c.order) > seenIDs {
+			delete(c.seen, c.order[0])
+			c.order = c.order[1:]
+		}
+	}
+	if f.Room != "" && (f.Type == Message || f.Type == Event) {
+		c.mu.Lock()
+		if f.Time.After(c.last) {
+			c.last = f.Time
+		}
+		c.mu.Unlock()
+	}
+	select {
+	case c.frames <- f:
+		return nil
+	case <-c.done:
+		return ErrClosed
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 多个chat进程可以组成集群共享房间:
+//
+//	chat -addr :8000 -node a -cluster :7000 -peers localhost:7001,localhost:7002
+//	chat -addr :8001 -node b -cluster :7001 -peers localhost:7000,localhost:7002
+//	chat -addr :8002 -node c -cluster :7002 -peers localhost:7000,localhost:7001
+//
+// 每个节点的broadcaster把本节点用户的消息和加入、离开事件发到bus，
+// 收到其它节点的事件后写入本节点的历史记录并发给本节点的成员。
+// 每个节点记录所有节点上每个房间的成员和在线用户(不管在不在房间里)，/who、昵称是否已被占用和私信都按整个集群计算。
+// 节点之间定期发送完整的成员列表(sync)，断开的节点和太久没有消息的节点的成员会被移除。
+// 昵称检查只看本节点已经知道的在线用户: 两个节点几乎同时注册同一个昵称，或者节点之间的连接断开时，
+// 两边都可能注册成功，这时私信发给本节点的那一个。
+
+const (
+	clusterSync  = 30 * time.Second
+	recentEvents = 16384
+)
+
+type clusterState struct {
+	node string
+	bus  bus
+
+	mu       sync.Mutex
+	presence map[string]map[string]map[string]bool // node -> room -> nick
+	online   map[string]map[string]bool            // node -> nick
+	heard    map[string]time.Time                  // 最近一次收到其它节点事件的时间
+}
+
+var cluster *clusterState
+
+func newCluster(node string, b bus) *clusterState {
+	return &clusterState{
+		node:     node,
+		bus:      b,
+		presence: map[string]map[string]map[string]bool{node: {}},
+		online:   map[string]map[string]bool{node: {}},
+		heard:    make(map[string]time.Time),
+	}
+}
+
+// publish 记录本节点的成员变化并把事件发给其它节点，由房间的broadcaster和users调用
+func (c *clusterState) publish(e busEvent) {
+	e.Node = c.node
+	if e.ID == "" {
+		e.ID = newMessageID()
+	}
+	c.mu.Lock()
+	c.apply(e)
+	c.mu.Unlock()
+	c.bus.Publish(e)
+}
+
+// apply 根据事件更新成员列表，调用时持有c.mu
+func (c *clusterState) apply(e busEvent) {
+	if e.Type == evSync {
+		rooms := make(map[string]map[string]bool, len(e.Rooms))
+		for room, nicks := range e.Rooms {
+			rooms[room] = make(map[string]bool, len(nicks))
+			for _, nick := range nicks {
+				rooms[room][nick] = true
+			}
+		}
+		c.presence[e.Node] = rooms
+		online := make(map[string]bool, len(e.Users))
+		for _, nick := range e.Users {
+			online[nick] = true
+		}
+		c.online[e.Node] = online
+		return
+	}
+	if c.online[e.Node] == nil {
+		c.online[e.Node] = make(map[string]bool)
+	}
+	switch e.Type {
+	case evOnline:
+		c.online[e.Node][e.Nick] = true
+		return
+	case evOffline:
+		delete(c.online[e.Node], e.Nick)
+		return
+	}
+	rooms, ok := c.presence[e.Node]
+	if !ok {
+		rooms = make(map[string]map[string]bool)
+		c.presence[e.Node] = rooms
+	}
+	switch e.Type {
+	case evJoin:
+		if rooms[e.Room] == nil {
+			rooms[e.Room] = make(map[string]bool)
+		}
+		rooms[e.Room][e.Nick] = true
+	case evLeave:
+		delete(rooms[e.Room], e.Nick)
+		if len(rooms[e.Room]) == 0 {
+			delete(rooms, e.Room)
+		}
+	case evRename:
+		if nicks := rooms[e.Room]; nicks[e.Nick] {
+			delete(nicks, e.Nick)
+			nicks[e.To] = true
+		}
+	}
+}
+
+// run 处理其它节点发来的事件，并定期发送sync
+func (c *clusterState) run() {
+	seen := newRecentIDs(recentEvents)
+	ticker := time.NewTicker(clusterSync)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-c.bus.Events():
+			c.receive(e, seen)
+		case now := <-ticker.C:
+			c.sync()
+			c.expire(now)
+		}
+	}
+}
+
+func (c *clusterState) receive(e busEvent, seen *recentIDs) {
+	switch e.Type {
+	case evUp:
+		c.sync()
+		return
+	case evDown:
+		c.forget(e.Node)
+		return
+	}
+	if e.Node == c.node || e.Node == "" || !seen.add(e.ID) {
+		return
+	}
+	c.mu.Lock()
+	c.heard[e.Node] = time.Now()
+	c.apply(e)
+	c.mu.Unlock()
+	switch e.Type {
+	case evMessage, evJoin, evLeave, evRename:
+		// 房间名会用作历史记录的文件名，不能相信其它节点
+		if e.Msg == nil || !validName.MatchString(e.Msg.Room) {
+			log.Printf("cluster: bad %s event from %s", e.Type, e.Node)
+			return
+		}
+		rooms.deliver(*e.Msg)
+	case evPrivate:
+		users.send(e.To, e.Nick, e.Text)
+	case evModerate:
+		if e.Mod != nil {
+			log.Printf("cluster: %s from node %s: %s", e.Mod.Action, e.Node, e.Mod.apply())
+		}
+	}
+}
+
+// sync 把本节点完整的成员列表发给其它节点
+func (c *clusterState) sync() {
+	c.mu.Lock()
+	rooms := make(map[string][]string)
+	for room, nicks := range c.presence[c.node] {
+		for nick := range nicks {
+			rooms[room] = append(rooms[room], nick)
+		}
+	}
+	var online []string
+	for nick := range c.online[c.node] {
+		online = append(online, nick)
+	}
+	c.mu.Unlock()
+	c.bus.Publish(busEvent{ID: newMessageID(), Node: c.node, Type: evSync, Rooms: rooms, Users: online})
+}
+
+// expire 移除太久没有消息的节点，正常情况下每个节点每 clusterSync 至少发送一次sync
+func (c *clusterState) expire(now time.Time) {
+	c.mu.Lock()
+	var stale []string
+	for node, t := range c.heard {
+		if now.Sub(t) > 3*clusterSync {
+			stale = append(stale, node)
+		}
+	}
+	c.mu.Unlock()
+	for _, node := range stale {
+		log.Printf("cluster: nothing from node %s for %v", node, 3*clusterSync)
+		c.forget(node)
+	}
+}
+
+func (c *clusterState) forget(node string) {
+	c.mu.Lock()
+	delete(c.presence, node)
+	delete(c.online, node)
+	delete(c.heard, node)
+	c.mu.Unlock()
+}
+
+// members 返回其它节点上房间的成员
+func (c *clusterState) members(room string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for node, rooms := range c.presence {
+		if node == c.node {
+			continue
+		}
+		for nick := range rooms[room] {
+			names = append(names, nick+"@"+node)
+		}
+	}
+	return names
+}
+
+// remote 返回其它节点上使用nick的用户所在的节点，昵称不区分大小写
+func (c *clusterState) remote(nick string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for node, nicks := range c.online {
+		if node == c.node {
+			continue
+		}
+		for other := range nicks {
+			if strings.EqualFold(other, nick) {
+				return node, true
+			}
+		}
+	}
+	return "", false
+}
+
+// sendPrivate 发送私信，用户不在本节点时转发给集群
+func (c *clusterState) sendPrivate(to, from, text string) error {
+	err := users.send(to, from, text)
+	if err != errNoSuchUser {
+		return err
+	}
+	if _, ok := c.remote(to); !ok {
+		return errNoSuchUser
+	}
+	c.publish(busEvent{Type: evPrivate, Nick: from, To: to, Text: text})
+	return nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const help = `commands:
+  /join <room> [since] join a room and make it the current room, replaying recent
+                       messages: a count, a duration like 2h or an RFC3339 time
+  /leave [room]        leave a room, the current room by default
+  /say <room> <text>   send to a joined room without making it the current room
+  /nick <name>         change your nickname
+  /msg <user> <text>   send a private message
+  /who [room]          list the members of a room
+  /history [room] [n]  show page n of a room's history, 1 is the newest
+  /format text|json    switch between plain text and JSON frames
+  /help                show this message
+  /pong <n>            answer a PING from the server`
+
+const helpNotes = `other lines are sent to the current room, start a line with // to send one beginning with /`
+
+// handle 处理客户端输入的一行
+func (u *user) handle(line string) {
+	if !u.throttle() {
+		return
+	}
+	if !strings.HasPrefix(line, "/") {
+		u.say(u.current, line)
+		return
+	}
+	if strings.HasPrefix(line, "//") {
+		u.say(u.current, line[1:])
+		return
+	}
+	// /msg 的正文要保留原有的空白，所以最多只切出三段
+	args := strings.SplitN(strings.TrimSpace(line), " ", 3)
+	switch cmd := args[0]; {
+	case cmd == "/join" && len(args) >= 2:
+		rp, err := parseReplay(strings.Join(args[2:], ""))
+		if err != nil {
+			u.notify(err.Error())
+			return
+		}
+		u.join(args[1], rp)
+	case cmd == "/leave" && len(args) <= 2:
+		name := ""
+		if len(args) == 2 {
+			name = args[1]
+		} else if u.current != nil {
+			name = u.current.name
+		}
+		u.leave(name)
+	case cmd == "/say" && len(args) == 3:
+		r, ok := u.rooms[args[1]]
+		if !ok {
+			u.notify("you are not in room " + args[1])
+			return
+		}
+		u.say(r, args[2])
+	case cmd == "/nick" && len(args) == 2:
+		if auth != nil {
+			u.notify("nicknames are the login names when login is required")
+			return
+		}
+		u.rename(args[1])
+	case cmd == "/msg" && len(args) == 3:
+		m := message{From: u.nick, Text: args[2]}
+		if !filter(u, &m) {
+			return
+		}
+		if err := cluster.sendPrivate(args[1], u.nick, m.Text); err != nil {
+			u.notify(fmt.Sprintf("%s: %v", args[1], err))
+		}
+	case cmd == "/who" && len(args) <= 2:
+		u.who(args[1:])
+	case cmd == "/history":
+		u.history(args[1:])
+	case cmd == "/format":
+		u.out <- u.f.format(args[1:])
+	case cmd == "/help":
+		u.notify(u.helpText())
+	case u.runCommand(line):
+	default:
+		u.notify("unknown command or wrong arguments: " + line + ", type /help for commands")
+	}
+}
+
+func (u *user) say(r *room, text string) {
+	if r == nil {
+		u.notify("you are not in any room, /join one first")
+		return
+	}
+	m := message{From: u.nick, Text: text}
+	if !filter(u, &m) {
+		return
+	}
+	r.messages <- m
+}
+
+// join 加入房间并切换为当前房间，已经在房间里时只切换
+func (u *user) join(name string, rp replay) {
+	if !validName.MatchString(name) {
+		u.notify(errInvalidName.Error())
+		return
+	}
+	r, ok := u.rooms[name]
+	if !ok {
+		if len(u.rooms) >= *maxRooms {
+			u.notify(fmt.Sprintf("you can be in at most %d rooms, /leave one first", *maxRooms))
+			return
+		}
+		r = rooms.get(name)
+		r.entering <- join{u, rp}
+		u.rooms[name] = r
+	}
+	u.current = r
+	u.notify(fmt.Sprintf("[%s] you are talking here now, members: %s", name, strings.Join(r.members(), ", ")))
+}
+
+func (u *user) leave(name string) {
+	r, ok := u.rooms[name]
+	if !ok {
+		u.notify("you are not in room " + name)
+		return
+	}
+	u.part(r)
+	if u.current == r {
+		// 切换到剩下的房间中名字最小的一个
+		u.current = nil
+		if names := u.joined(); len(names) > 0 {
+			u.current = u.rooms[names[0]]
+		}
+	}
+	if u.current != nil {
+		u.notify(fmt.Sprintf("left %s, talking in %s now", name, u.current.name))
+	} else {
+		u.notify(fmt.Sprintf("left %s, /join a room to keep talking", name))
+	}
+}
+
+func (u *user) rename(nick string) {
+	old := u.nick
+	if err := users.rename(u, nick); err != nil {
+		u.notify(err.Error())
+		return
+	}
+	for _, name := range u.joined() {
+		u.rooms[name].renaming <- rename{old, nick}
+	}
+	if len(u.rooms) == 0 {
+		u.notify("you are now known as " + nick)
+	}
+}
+
+func (u *user) who(args []string) {
+	r := u.current
+	if len(args) == 1 {
+		var ok bool
+		if r, ok = rooms.lookup(args[0]); !ok {
+			// 本节点没有人在这个房间，其它节点上可能有
+			names := cluster.members(args[0])
+			if len(names) == 0 {
+				u.notify("no such room: " + args[0])
+				return
+			}
+			sort.Strings(names)
+			u.notify(fmt.Sprintf("[%s] members: %s", args[0], strings.Join(names, ", ")))
+			return
+		}
+	}
+	if r == nil {
+		u.notify("you are not in any room")
+		return
+	}
+	u.notify(fmt.Sprintf("[%s] members: %s", r.name, strings.Join(r.members(), ", ")))
+}
+
+// history 分页显示房间的历史消息: /history [room] [page]。只能看自己加入了的房间
+func (u *user) history(args []string) {
+	r, page := u.current, 1
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil && n > 0 {
+			page = n
+		} else if validName.MatchString(arg) {
+			var ok bool
+			if r, ok = u.rooms[arg]; !ok {
+				u.notify("you are not in room " + arg)
+				return
+			}
+		} else {
+			u.notify("usage: /history [room] [page]")
+			return
+		}
+	}
+	if r == nil {
+		u.notify("you are not in any room")
+		return
+	}
+	msgs, pages, err := r.history.page(page, *historyPage)
+	if err != nil {
+		u.notify("history unavailable: " + err.Error())
+		return
+	}
+	if len(msgs) == 0 {
+		u.notify(fmt.Sprintf("[%s] no history on page %d", r.name, page))
+		return
+	}
+	for _, m := range msgs {
+		u.showHistory(m)
+	}
+	if page < pages {
+		u.notify(fmt.Sprintf("--- page %d of %d, /history %s %d for older messages ---", page, pages, r.name, page+1))
+	} else {
+		u.notify(fmt.Sprintf("--- page %d of %d ---", page, pages))
+	}
+}
+
+// part 离开房间，离开后房间不会再往u.out发送消息
+func (u *user) part(r *room) {
+	r.leaving <- u
+	delete(u.rooms, r.name)
+	rooms.release(r)
+}
+
+// quit 离开所有房间并注销用户
+func (u *user) quit() {
+	for _, r := range u.rooms {
+		u.part(r)
+	}
+	users.remove(u)
+}
+
+// joined 返回已加入的房间名，按名字排序
+func (u *user) joined() []string {
+	names := make([]string, 0, len(u.rooms))
+	for name := range u.rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 客户端发送 "/format json" 切换到结构化模式，输入昵称之前也可以切换。之后服务器发出的每一行是一个JSON frame:
+//
+//	{"type":"message","id":"9c1e52a0-17","room":"lobby","from":"alice","text":"hi","timestamp":"2019-03-18T10:00:00Z"}
+//
+// type 是以下之一:
+//
+//	message  房间里用户发送的消息
+//	event    房间里的系统事件: 加入、离开、改名
+//	private  私信
+//	notice   只发给这个客户端的提示、命令的输出和错误
+//	welcome  登录成功，from是分配到的昵称
+//	ping     心跳，客户端用 {"type":"pong"} 回应
+//
+// 回放的历史消息带有 "history": true。客户端发送的每一行也是一个frame:
+//
+//	{"type":"message","room":"lobby","text":"hi"}  room为空时发到当前房间
+//	{"type":"command","text":"/join ops"}
+//	{"type":"login","text":"alice"}                昵称，需要登录时是 "<name> <password>" 或 "token <token>"
+//	{"type":"pong"}
+//
+// "/format text" 切换回文本模式。Go客户端见 go-practice/src/chat/client。
+
+const (
+	frameMessage = "message"
+	frameEvent   = "event"
+	framePrivate = "private"
+	frameNotice  = "notice"
+	frameWelcome = "welcome"
+	framePing    = "ping"
+	framePong    = "pong"
+	frameCommand = "command"
+	frameLogin   = "login"
+)
+
+type frame struct {
+	Type    string    `json:"type"`
+	ID      string    `json:"id,omitempty"`
+	Room    string    `json:"room,omitempty"`
+	From    string    `json:"from,omitempty"`
+	Text    string    `json:"text"`
+	Time    time.Time `json:"timestamp"`
+	History bool      `json:"history,omitempty"`
+}
+
+// framer 记录一个连接使用的格式，把frame编码成发给这个连接的一行
+type framer struct {
+	json int32
+}
+
+func (f *framer) setJSON(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&f.json, v)
+}
+
+func (f *framer) isJSON() bool {
+	return atomic.LoadInt32(&f.json) == 1
+}
+
+func (f *framer) encode(fr frame) string {
+	if fr.Time.IsZero() {
+		fr.Time = time.Now()
+	}
+	if f.isJSON() {
+		b, _ := json.Marshal(fr)
+		return string(b)
+	}
+	var s string
+	switch fr.Type {
+	case frameMessage:
+		s = fmt.Sprintf("[%s] %s: %s", fr.Room, fr.From, fr.Text)
+	case frameEvent:
+		s = fmt.Sprintf("[%s] %s", fr.Room, fr.Text)
+	case framePrivate:
+		s = fmt.Sprintf("[private] %s: %s", fr.From, fr.Text)
+	case framePing:
+		s = "PING " + fr.Text
+	default:
+		s = fr.Text
+	}
+	if fr.History {
+		s = fr.Time.Format("2006-01-02 15:04:05 ") + s
+	}
+	return s
+}
+
+func (f *framer) notice(text string) string {
+	return f.encode(frame{Type: frameNotice, Text: text})
+}
+
+// format 处理 /format 命令，返回用新格式编码的回复
+func (f *framer) format(args []string) string {
+	if len(args) != 1 || (args[0] != "json" && args[0] != "text") {
+		return f.notice("usage: /format text|json")
+	}
+	f.setJSON(args[0] == "json")
+	return f.notice("format is " + args[0] + " now")
+}
+
+// input 把JSON模式下客户端发来的frame转换成文本模式中等价的一行，文本模式下原样返回
+func (f *framer) input(line string) (string, error) {
+	if !f.isJSON() {
+		return line, nil
+	}
+	var fr frame
+	if err := json.Unmarshal([]byte(line), &fr); err != nil {
+		return "", fmt.Errorf("bad frame: %v", err)
+	}
+	switch fr.Type {
+	case frameMessage:
+		if fr.Room != "" {
+			return "/say " + fr.Room + " " + fr.Text, nil
+		}
+		if strings.HasPrefix(fr.Text, "/") {
+			return "/" + fr.Text, nil
+		}
+		return fr.Text, nil
+	case frameCommand:
+		if !strings.HasPrefix(fr.Text, "/") {
+			return "", fmt.Errorf("bad frame: commands start with /")
+		}
+		return fr.Text, nil
+	case frameLogin:
+		return fr.Text, nil
+	case framePong:
+		return "/pong " + fr.Text, nil
+	}
+	return "", fmt.Errorf("bad frame: unknown type %q", fr.Type)
+}
+
+// 消息id由进程启动时随机生成的前缀和递增的序号组成
+var (
+	idPrefix = randomHex(4)
+	idSeq    uint64
+)
+
+func newMessageID() string {
+	return fmt.Sprintf("%s-%d", idPrefix, atomic.AddUint64(&idSeq, 1))
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HTTP网关让浏览器和脚本加入和TCP客户端相同的房间:
+//
+//	GET    /ws                     WebSocket，协议和TCP相同: 第一条消息是昵称，之后每条消息是一行输入
+//	POST   /sessions?nick=alice    创建会话，返回 {"id": ...}，加上 &format=json 使用JSON frame
+//	POST   /sessions/{id}          请求体的每一行作为一行输入(消息或者命令，JSON会话是frame)
+//	GET    /sessions/{id}/events   SSE，每条发给该用户的消息是一个event
+//	GET    /sessions/{id}/poll     长轮询，等待最多 ?timeout=30s，返回 {"messages": [...]}
+//	DELETE /sessions/{id}          离开所有房间并结束会话
+//
+// 会话的用户和TCP用户一样通过client channel接收消息，经过同样的发送队列。
+// 超过 -session-ttl 没有SSE连接或轮询的会话会被结束。
+// 浏览器只能从网关自己的host或者 -ws-origins 列出的来源打开WebSocket。
+
+const (
+	maxPoll    = 100
+	pollLinger = 20 * time.Millisecond
+)
+
+type session struct {
+	id    string
+	u     *user
+	out   chan string // 发送队列的输出
+	input chan string
+	done  chan struct{}
+	once  sync.Once
+
+	readers  int32 // 正在进行的SSE连接和轮询
+	lastRead int64 // 最近一次读取结束的时间，UnixNano
+}
+
+func (s *session) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *session) attach() func() {
+	atomic.AddInt32(&s.readers, 1)
+	return func() {
+		atomic.StoreInt64(&s.lastRead, time.Now().UnixNano())
+		atomic.AddInt32(&s.readers, -1)
+	}
+}
+
+// run 处理会话的输入，会话结束时按正常离开的流程退出
+func (s *session) run(ctx context.Context, ch chan string) {
+	ticker := time.NewTicker(monitorTick())
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case line := <-s.input:
+			s.u.handle(line)
+		case <-s.done:
+			break loop
+		case <-ctx.Done():
+			break loop
+		case now := <-ticker.C:
+			idle := now.Sub(time.Unix(0, atomic.LoadInt64(&s.lastRead)))
+			if atomic.LoadInt32(&s.readers) == 0 && idle > *sessionTTL {
+				log.Printf("session %s (%s) expired", s.id, s.u.nick)
+				break loop
+			}
+		}
+	}
+	s.Close()
+	s.u.quit()
+	sessions.Delete(s.id)
+	close(ch)
+	// 没有读取方时把剩余的消息丢掉，让发送队列退出
+	for range s.out {
+	}
+}
+
+var sessions sync.Map // id -> *session
+
+func gateway(ctx context.Context) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		wsConns.Add(1)
+		defer wsConns.Done()
+		handleConn(ctx, conn)
+	})
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		createSession(ctx, w, r)
+	})
+	mux.HandleFunc("/sessions/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/"), "/")
+		v, ok := sessions.Load(parts[0])
+		if !ok {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		s := v.(*session)
+		switch {
+		case len(parts) == 1 && r.Method == "POST":
+			sendLines(ctx, w, r, s)
+		case len(parts) == 1 && r.Method == "DELETE":
+			s.Close()
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 2 && parts[1] == "events" && r.Method == "GET":
+			streamEvents(ctx, w, r, s)
+		case len(parts) == 2 && parts[1] == "poll" && r.Method == "GET":
+			poll(ctx, w, r, s)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	})
+	return mux
+}
+
+// wsConns 用于退出时等待WebSocket连接结束，它们被接管以后http.Server不再跟踪
+var wsConns sync.WaitGroup
+
+func createSession(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	nick := r.FormValue("nick")
+	if auth != nil {
+		name, err := httpLogin(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="chat", Basic realm="chat"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		nick = name
+	}
+	f := &framer{}
+	switch r.FormValue("format") {
+	case "", "text":
+	case "json":
+		f.setJSON(true)
+	default:
+		http.Error(w, "format must be text or json", http.StatusBadRequest)
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s := &session{
+		id:       hex.EncodeToString(b),
+		out:      make(chan string),
+		input:    make(chan string),
+		done:     make(chan struct{}),
+		lastRead: time.Now().UnixNano(),
+	}
+	ch := make(chan string)
+	s.u = newUser(r.RemoteAddr, ch, f, func(reason string) {
+		log.Printf("ending session %s: %s", s.id, reason)
+		s.Close()
+	})
+	if err := users.register(s.u, nick); err != nil {
+		status := http.StatusBadRequest
+		if err == errNickTaken {
+			status = http.StatusConflict
+		} else if _, ok := err.(bannedError); ok {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	go queue(ch, s.out, &evictor{addr: "session " + s.id, c: s}, f)
+	sessions.Store(s.id, s)
+	go s.run(ctx, ch)
+	s.input <- "/join " + *lobby
+	log.Printf("session %s: %s from %s", s.id, s.u.nick, r.RemoteAddr)
+	writeJSON(w, http.StatusCreated, map[string]string{"id": s.id, "nick": s.u.nick})
+}
+
+// httpLogin 校验Authorization头中的bearer token或Basic认证的用户名密码
+func httpLogin(r *http.Request) (string, error) {
+	ip := hostOf(r.RemoteAddr)
+	if logins.wait(ip) > 0 {
+		return "", errLockedOut
+	}
+	var name string
+	var err error
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		name, err = auth.token(strings.TrimPrefix(h, "Bearer "))
+	} else if user, pass, ok := r.BasicAuth(); ok {
+		name, err = auth.password(user, pass)
+	} else {
+		return "", errLoginFailed
+	}
+	if err != nil {
+		logins.fail(ip)
+		log.Printf("login from %s failed", r.RemoteAddr)
+		return "", err
+	}
+	logins.succeed(ip)
+	return name, nil
+}
+
+func sendLines(ctx context.Context, w http.ResponseWriter, r *http.Request, s *session) {
+	input := bufio.NewScanner(io.LimitReader(r.Body, 1<<20))
+	for input.Scan() {
+		line, err := s.u.f.input(input.Text())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		select {
+		case s.input <- line:
+		case <-s.done:
+			http.Error(w, "session closed", http.StatusGone)
+			return
+		case <-ctx.Done():
+			http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func streamEvents(ctx context.Context, w http.ResponseWriter, r *http.Request, s *session) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	defer s.attach()()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case msg, ok := <-s.out:
+			if !ok {
+				return
+			}
+			// 多行的消息(比如/help)每行一个data字段
+			fmt.Fprintf(w, "data: %s\n\n", strings.Replace(msg, "\n", "\ndata: ", -1))
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-ctx.Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func poll(ctx context.Context, w http.ResponseWriter, r *http.Request, s *session) {
+	timeout := 30 * time.Second
+	if v := r.FormValue("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 || d > *sessionTTL {
+			http.Error(w, "bad timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+	defer s.attach()()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	msgs := []string{}
+	// 等到第一条消息，然后把随后很快到达的消息一起返回
+	select {
+	case msg, ok := <-s.out:
+		if !ok {
+			http.Error(w, "session closed", http.StatusGone)
+			return
+		}
+		msgs = append(msgs, msg)
+	case <-timer.C:
+	case <-r.Context().Done():
+		return
+	case <-ctx.Done():
+	}
+	linger := time.After(pollLinger)
+drain:
+	for len(msgs) > 0 && len(msgs) < maxPoll {
+		select {
+		case msg, ok := <-s.out:
+			if !ok {
+				break drain
+			}
+			msgs = append(msgs, msg)
+		case <-linger:
+			break drain
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"messages": msgs})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
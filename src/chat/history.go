@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 每个房间的历史消息追加写在 <-history>/<room>.log，一行一条JSON:
+//	{"time":"2019-04-20T10:00:00+08:00","room":"ops","from":"alice","text":"deploying"}
+// 内存中只保存每条消息的偏移和时间，回放和翻页时再从文件读取。
+
+// maxReplay 限制一次回放的条数，太多的消息会被慢客户端的发送队列丢弃
+const maxReplay = 1000
+
+type logEntry struct {
+	off  int64
+	time int64 // UnixNano
+}
+
+type history struct {
+	mu    sync.Mutex
+	f     *os.File
+	size  int64
+	index []logEntry
+}
+
+// openHistory 打开历史记录并建立索引。
+// 进程在写入过程中崩溃留下的不完整的最后一行会被截掉
+func openHistory(path string) (*history, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	h := &history{f: f}
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			f.Close()
+			return nil, err
+		}
+		var m message
+		if json.Unmarshal(line, &m) == nil {
+			h.index = append(h.index, logEntry{off: h.size, time: m.Time.UnixNano()})
+		}
+		h.size += int64(len(line))
+	}
+	if err := f.Truncate(h.size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(h.size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *history) append(m message) error {
+	if h == nil {
+		return nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n, err := h.f.Write(append(data, '\n'))
+	if err != nil {
+		// 写了一半的行会让后面的消息无法解析，回退到写之前的位置
+		h.f.Truncate(h.size)
+		h.f.Seek(h.size, io.SeekStart)
+		return err
+	}
+	h.index = append(h.index, logEntry{off: h.size, time: m.Time.UnixNano()})
+	h.size += int64(n)
+	return nil
+}
+
+func (h *history) close() error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.f.Close()
+}
+
+// appendHistory 把一条消息追加到没有打开的历史记录，下次openHistory时建立索引
+func appendHistory(path string, m message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// read 返回第from条到第to条(不含)之间的消息
+func (h *history) read(from, to int) ([]message, error) {
+	if from >= to {
+		return nil, nil
+	}
+	end := h.size
+	if to < len(h.index) {
+		end = h.index[to].off
+	}
+	buf := make([]byte, end-h.index[from].off)
+	if _, err := h.f.ReadAt(buf, h.index[from].off); err != nil {
+		return nil, err
+	}
+	msgs := make([]message, 0, to-from)
+	for _, line := range bytes.Split(bytes.TrimSuffix(buf, []byte("\n")), []byte("\n")) {
+		var m message
+		if json.Unmarshal(line, &m) == nil {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs, nil
+}
+
+// last 返回最近的n条消息，最多maxReplay条
+func (h *history) last(n int) ([]message, error) {
+	if h == nil {
+		return nil, nil
+	}
+	if n > maxReplay {
+		n = maxReplay
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	from := len(h.index) - n
+	if from < 0 {
+		from = 0
+	}
+	return h.read(from, len(h.index))
+}
+
+// since 返回t之后的消息，最多maxReplay条
+func (h *history) since(t time.Time) ([]message, error) {
+	if h == nil {
+		return nil, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	from := sort.Search(len(h.index), func(i int) bool { return h.index[i].time >= t.UnixNano() })
+	if len(h.index)-from > maxReplay {
+		from = len(h.index) - maxReplay
+	}
+	return h.read(from, len(h.index))
+}
+
+// page 从最新的消息往前翻页，第1页是最近的size条，同时返回总页数
+func (h *history) page(p, size int) ([]message, int, error) {
+	if h == nil {
+		return nil, 0, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	pages := (len(h.index) + size - 1) / size
+	to := len(h.index) - (p-1)*size
+	from := to - size
+	if from < 0 {
+		from = 0
+	}
+	if to < 0 {
+		to = 0
+	}
+	msgs, err := h.read(from, to)
+	return msgs, pages, err
+}
+
+// replay 描述加入房间时回放哪些消息: 最近last条，或者since之后的所有消息
+type replay struct {
+	last  int
+	since time.Time
+}
+
+// parseReplay 解析 /join 的第二个参数: 条数、时长(如2h，表示最近两小时)或者RFC3339时间，
+// 为空时回放最近 -replay 条
+func parseReplay(arg string) (replay, error) {
+	if arg == "" {
+		return replay{last: *replayLast}, nil
+	}
+	if n, err := strconv.Atoi(arg); err == nil && n >= 0 {
+		return replay{last: n}, nil
+	}
+	if d, err := time.ParseDuration(arg); err == nil && d > 0 {
+		return replay{since: time.Now().Add(-d)}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, arg); err == nil {
+		return replay{since: t}, nil
+	}
+	return replay{}, fmt.Errorf("bad history argument %q, want a count, a duration like 2h or an RFC3339 time", arg)
+}
+
+func (rp replay) read(h *history) ([]message, error) {
+	if !rp.since.IsZero() {
+		return h.since(rp.since)
+	}
+	return h.last(rp.last)
+}
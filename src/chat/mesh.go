@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// meshBus 是TCP全互联的bus: 每个节点在 -cluster 上监听，并主动连接 -peers 中的每一个节点，
+// 断开后不断重连。两个节点互相连接时会有两条连接，事件在每条连接上都发送一次，由接收方去重。
+// 连接上每行一个JSON编码的busEvent。双方先各发一行 {"type":"hello","node":...,"text":<随机nonce>}，
+// 再各发一行 {"type":"auth","text":<meshProof>} 证明自己知道 -cluster-secret，secret本身不在连接上传输。
+// 跟不上的连接会被断开，重连以后通过sync恢复成员列表，断开期间的消息不会补发。
+
+const (
+	meshQueue     = 1024
+	meshHandshake = 10 * time.Second
+	meshKeepalive = 15 * time.Second // 空闲连接发送心跳的间隔，3倍时间收不到数据认为连接已断开
+)
+
+var (
+	errMeshSelf     = errors.New("connected to self")
+	errMeshNoSecret = errors.New("cluster secret must not be empty")
+)
+
+type meshBus struct {
+	node   string
+	secret string
+	ln     net.Listener
+	events chan busEvent
+	done   chan struct{}
+
+	// nodeMu 保证同一个节点的up和down通知按顺序发出，不和Publish共用锁，
+	// events满的时候Publish也不会被阻塞
+	nodeMu sync.Mutex
+	mu     sync.Mutex
+	links  map[*meshLink]bool
+	byNode map[string]int // 每个节点的连接数
+}
+
+type meshLink struct {
+	node string
+	conn net.Conn
+	out  chan []byte
+	once sync.Once
+}
+
+func (l *meshLink) close() {
+	l.once.Do(func() { l.conn.Close() })
+}
+
+func newMeshBus(node, addr string, peers []string, secret string) (*meshBus, error) {
+	// 空secret的HMAC谁都能算出来，等于不认证
+	if secret == "" {
+		return nil, errMeshNoSecret
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	m := &meshBus{
+		node:   node,
+		secret: secret,
+		ln:     ln,
+		events: make(chan busEvent, meshQueue),
+		done:   make(chan struct{}),
+		links:  make(map[*meshLink]bool),
+		byNode: make(map[string]int),
+	}
+	go m.accept()
+	for _, peer := range peers {
+		go m.dial(peer)
+	}
+	log.Printf("cluster node %s listening on %s, peers %v", node, ln.Addr(), peers)
+	return m, nil
+}
+
+func (m *meshBus) accept() {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			select {
+			case <-m.done:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			log.Printf("cluster: %v", err)
+			return
+		}
+		go func() {
+			if err := m.serve(conn); err != nil {
+				log.Printf("cluster: link from %s: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// dial 保持一条到peer的连接，断开后按指数退避重连
+func (m *meshBus) dial(peer string) {
+	backoff := 100 * time.Millisecond
+	for {
+		conn, err := net.DialTimeout("tcp", peer, meshHandshake)
+		if err == nil {
+			start := time.Now()
+			err = m.serve(conn)
+			if err == errMeshSelf {
+				log.Printf("cluster: %s is this node, not dialing it", peer)
+				return
+			}
+			if time.Since(start) > time.Minute {
+				backoff = 100 * time.Millisecond
+			}
+		}
+		log.Printf("cluster: link to %s: %v, retrying in %v", peer, err, backoff)
+		select {
+		case <-m.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > 10*time.Second {
+			backoff = 10 * time.Second
+		}
+	}
+}
+
+// meshProof 证明发送方知道secret。verifierNonce是接收方的nonce，proverNonce和node是发送方的，
+// 所以证明不能重放到别的连接上；node不能是接收方自己，所以也不能把接收方的证明发回给它
+func meshProof(secret, verifierNonce, proverNonce, node string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(verifierNonce + "\n" + proverNonce + "\n" + node))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// serve 握手并运行一条连接直到断开
+func (m *meshBus) serve(conn net.Conn) error {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(meshHandshake))
+	nonce := randomHex(16)
+	hello, _ := json.Marshal(busEvent{Type: "hello", Node: m.node, Text: nonce})
+	if _, err := conn.Write(append(hello, '\n')); err != nil {
+		return err
+	}
+	input := bufio.NewScanner(conn)
+	input.Buffer(make([]byte, 4096), 1<<20)
+	readHandshake := func(typ string) (busEvent, error) {
+		var e busEvent
+		if !input.Scan() {
+			if err := input.Err(); err != nil {
+				return e, err
+			}
+			return e, errors.New("closed during handshake")
+		}
+		if err := json.Unmarshal(input.Bytes(), &e); err != nil || e.Type != typ {
+			return e, errors.New("bad handshake")
+		}
+		return e, nil
+	}
+	peer, err := readHandshake("hello")
+	if err != nil {
+		return err
+	}
+	if peer.Node == "" || peer.Text == "" {
+		return errors.New("bad handshake")
+	}
+	if peer.Node == m.node {
+		return errMeshSelf
+	}
+	auth, _ := json.Marshal(busEvent{Type: "auth", Node: m.node, Text: meshProof(m.secret, peer.Text, nonce, m.node)})
+	if _, err := conn.Write(append(auth, '\n')); err != nil {
+		return err
+	}
+	proof, err := readHandshake("auth")
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(proof.Text), []byte(meshProof(m.secret, nonce, peer.Text, peer.Node))) {
+		return errors.New("wrong cluster secret")
+	}
+	conn.SetDeadline(time.Time{})
+
+	l := &meshLink{node: peer.Node, conn: conn, out: make(chan []byte, meshQueue)}
+	if !m.add(l) {
+		return errors.New("bus closed")
+	}
+	defer m.remove(l)
+	go m.write(l)
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * meshKeepalive))
+		if !input.Scan() {
+			break
+		}
+		var e busEvent
+		if err := json.Unmarshal(input.Bytes(), &e); err != nil {
+			return fmt.Errorf("%s: bad event: %v", l.node, err)
+		}
+		if e.Type == "keepalive" {
+			continue
+		}
+		select {
+		case m.events <- e:
+		case <-m.done:
+			return nil
+		}
+	}
+	if err := input.Err(); err != nil {
+		return fmt.Errorf("%s: %v", l.node, err)
+	}
+	return fmt.Errorf("%s: closed", l.node)
+}
+
+func (m *meshBus) write(l *meshLink) {
+	keepalive, _ := json.Marshal(busEvent{Type: "keepalive", Node: m.node})
+	keepalive = append(keepalive, '\n')
+	ticker := time.NewTicker(meshKeepalive)
+	defer ticker.Stop()
+	for {
+		var b []byte
+		select {
+		case b = <-l.out:
+		case <-ticker.C:
+			b = keepalive
+		case <-m.done:
+			l.close()
+			return
+		}
+		l.conn.SetWriteDeadline(time.Now().Add(*writeTimeout))
+		if _, err := l.conn.Write(b); err != nil {
+			l.close()
+			return
+		}
+	}
+}
+
+func (m *meshBus) add(l *meshLink) bool {
+	m.nodeMu.Lock()
+	defer m.nodeMu.Unlock()
+	m.mu.Lock()
+	select {
+	case <-m.done:
+		m.mu.Unlock()
+		return false
+	default:
+	}
+	m.links[l] = true
+	m.byNode[l.node]++
+	up := m.byNode[l.node] == 1
+	m.mu.Unlock()
+	if up {
+		log.Printf("cluster: node %s is up", l.node)
+		m.notify(busEvent{Type: evUp, Node: l.node})
+	}
+	return true
+}
+
+func (m *meshBus) remove(l *meshLink) {
+	l.close()
+	m.nodeMu.Lock()
+	defer m.nodeMu.Unlock()
+	m.mu.Lock()
+	delete(m.links, l)
+	m.byNode[l.node]--
+	down := m.byNode[l.node] == 0
+	if down {
+		delete(m.byNode, l.node)
+	}
+	m.mu.Unlock()
+	if down {
+		log.Printf("cluster: node %s is down", l.node)
+		m.notify(busEvent{Type: evDown, Node: l.node})
+	}
+}
+
+func (m *meshBus) notify(e busEvent) {
+	select {
+	case m.events <- e:
+	case <-m.done:
+	}
+}
+
+// Publish 在每条连接上发送一次。持有锁发送，所有连接上事件的顺序相同
+func (m *meshBus) Publish(e busEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("cluster: %v", err)
+		return
+	}
+	b = append(b, '\n')
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for l := range m.links {
+		select {
+		case l.out <- b:
+		default:
+			log.Printf("cluster: link to %s is too slow, disconnecting", l.node)
+			l.close()
+		}
+	}
+}
+
+func (m *meshBus) Events() <-chan busEvent {
+	return m.events
+}
+
+func (m *meshBus) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-m.done:
+		return nil
+	default:
+	}
+	close(m.done)
+	for l := range m.links {
+		l.close()
+	}
+	return m.ln.Close()
+}
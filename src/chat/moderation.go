@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// -admins 中的用户可以使用下面的管理命令。没有 -users 时谁都可以使用管理员的昵称，所以只适合测试。
+//
+//	/kick <user> [reason]                断开用户的连接
+//	/mute <user> [duration] [reason]     禁止用户在房间里发言和发私信，默认10分钟
+//	/unmute <user>
+//	/ban <user|ip> [duration] [reason]   断开用户并禁止这个昵称和它当前的IP登录，不指定时间时永久有效
+//	/unban <user|ip>
+//	/bans                                列出所有封禁
+//
+// 封禁保存在 -bans 文件中，重启以后仍然有效，禁言只保存在内存中。
+// 组成集群时管理操作转发给所有节点，每个节点各自保存封禁列表。
+
+const defaultMute = 10 * time.Minute
+
+type ban struct {
+	Nick    string    `json:"nick,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	By      string    `json:"by"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	Until   time.Time `json:"until"` // 零值表示永久
+}
+
+func (b *ban) active(now time.Time) bool {
+	return b.Until.IsZero() || now.Before(b.Until)
+}
+
+func (b *ban) String() string {
+	s := b.Nick
+	if b.IP != "" {
+		if s != "" {
+			s += " "
+		}
+		s += b.IP
+	}
+	s += " by " + b.By
+	if !b.Until.IsZero() {
+		s += " until " + b.Until.Format("2006-01-02 15:04:05")
+	}
+	if b.Reason != "" {
+		s += ": " + b.Reason
+	}
+	return s
+}
+
+// moderation 保存封禁和禁言
+type moderation struct {
+	path string // 为空时不保存封禁
+
+	mu    sync.Mutex
+	bans  []*ban
+	mutes map[string]time.Time // 小写的昵称 -> 禁言到什么时候
+}
+
+var (
+	mod    *moderation
+	admins map[string]bool // 小写的昵称
+)
+
+func isAdmin(nick string) bool {
+	return admins[strings.ToLower(nick)]
+}
+
+func loadModeration(path string) (*moderation, error) {
+	m := &moderation{path: path, mutes: make(map[string]time.Time)}
+	if path == "" {
+		return m, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &m.bans); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return m, nil
+}
+
+// save 去掉过期的封禁并写入文件，调用时持有m.mu
+func (m *moderation) save() error {
+	now := time.Now()
+	bans := m.bans[:0]
+	for _, b := range m.bans {
+		if b.active(now) {
+			bans = append(bans, b)
+		}
+	}
+	m.bans = bans
+	if m.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(m.bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	// 先写临时文件再改名，进程中途退出也不会留下写了一半的文件
+	tmp := m.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
+
+// banned 返回昵称或者IP的有效封禁
+func (m *moderation) banned(nick, ip string) (*ban, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for _, b := range m.bans {
+		if !b.active(now) {
+			continue
+		}
+		if (nick != "" && strings.EqualFold(b.Nick, nick)) || (ip != "" && b.IP == ip) {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+func (m *moderation) ban(b *ban) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bans = append(m.bans, b)
+	return m.save()
+}
+
+// unban 去掉昵称或者IP的所有封禁，返回去掉的个数
+func (m *moderation) unban(target string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bans, n := m.bans[:0], 0
+	for _, b := range m.bans {
+		if strings.EqualFold(b.Nick, target) || b.IP == target {
+			n++
+			continue
+		}
+		bans = append(bans, b)
+	}
+	m.bans = bans
+	if n == 0 {
+		return 0, nil
+	}
+	return n, m.save()
+}
+
+func (m *moderation) list() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	var list []string
+	for _, b := range m.bans {
+		if b.active(now) {
+			list = append(list, b.String())
+		}
+	}
+	return list
+}
+
+func (m *moderation) mute(nick string, until time.Time) {
+	m.mu.Lock()
+	m.mutes[strings.ToLower(nick)] = until
+	m.mu.Unlock()
+}
+
+func (m *moderation) unmute(nick string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := strings.ToLower(nick)
+	_, ok := m.mutes[key]
+	delete(m.mutes, key)
+	return ok
+}
+
+// muted 返回用户被禁言到什么时候
+func (m *moderation) muted(nick string) (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := strings.ToLower(nick)
+	until, ok := m.mutes[key]
+	if ok && time.Now().After(until) {
+		delete(m.mutes, key)
+		return time.Time{}, false
+	}
+	return until, ok
+}
+
+// modAction 是一次管理操作，在本节点执行以后转发给集群中的其它节点
+type modAction struct {
+	Action string    `json:"action"` // kick, ban, unban, mute, unmute
+	Target string    `json:"target"`
+	By     string    `json:"by"`
+	Reason string    `json:"reason,omitempty"`
+	Until  time.Time `json:"until"`
+}
+
+// apply 在本节点执行管理操作，返回给管理员看的结果
+func (a modAction) apply() string {
+	reason := ""
+	if a.Reason != "" {
+		reason = ": " + a.Reason
+	}
+	switch a.Action {
+	case "kick":
+		if kick(a.Target, fmt.Sprintf("*** you have been kicked by %s%s", a.By, reason), "kicked by "+a.By) != "" {
+			return "kicked " + a.Target
+		}
+		return a.Target + " is not on this node"
+	case "ban":
+		b := &ban{By: a.By, Reason: a.Reason, Created: time.Now(), Until: a.Until}
+		if net.ParseIP(a.Target) != nil {
+			b.IP = a.Target
+		} else {
+			b.Nick = a.Target
+			if addr := kick(a.Target, fmt.Sprintf("*** you have been banned by %s%s", a.By, reason), "banned by "+a.By); addr != "" {
+				b.IP = hostOf(addr)
+			}
+		}
+		if err := mod.ban(b); err != nil {
+			log.Printf("saving bans: %v", err)
+			return "banned " + b.String() + ", but saving the ban list failed: " + err.Error()
+		}
+		return "banned " + b.String()
+	case "unban":
+		n, err := mod.unban(a.Target)
+		if err != nil {
+			log.Printf("saving bans: %v", err)
+		}
+		return fmt.Sprintf("removed %d bans of %s", n, a.Target)
+	case "mute":
+		mod.mute(a.Target, a.Until)
+		users.with(a.Target, func(u *user) {
+			u.notify(fmt.Sprintf("*** you have been muted by %s until %s%s", a.By, a.Until.Format("2006-01-02 15:04:05"), reason))
+		})
+		return fmt.Sprintf("muted %s until %s", a.Target, a.Until.Format("2006-01-02 15:04:05"))
+	case "unmute":
+		if mod.unmute(a.Target) {
+			return "unmuted " + a.Target
+		}
+		return a.Target + " is not muted"
+	}
+	return "unknown action " + a.Action
+}
+
+// kick 断开本节点上的用户，返回用户的地址，用户不在本节点时返回空
+func kick(nick, msg, reason string) string {
+	var addr string
+	users.with(nick, func(u *user) {
+		u.notify(msg)
+		u.disconnect(reason)
+		addr = u.addr
+	})
+	return addr
+}
+
+// moderate 执行管理命令并转发给集群
+func moderate(u *user, a modAction) {
+	a.By = u.nick
+	u.notify(a.apply())
+	cluster.publish(busEvent{Type: evModerate, Mod: &a})
+}
+
+// parseModeration 解析 "<target> [duration] [reason]"
+func parseModeration(args string, defaultDuration time.Duration) (modAction, error) {
+	fields := strings.SplitN(args, " ", 3)
+	if fields[0] == "" {
+		return modAction{}, fmt.Errorf("missing user")
+	}
+	a := modAction{Target: fields[0]}
+	rest := fields[1:]
+	d := defaultDuration
+	if len(rest) > 0 {
+		if v, err := time.ParseDuration(rest[0]); err == nil && v > 0 {
+			d, rest = v, rest[1:]
+		}
+	}
+	if d > 0 {
+		a.Until = time.Now().Add(d)
+	}
+	a.Reason = strings.TrimSpace(strings.Join(rest, " "))
+	return a, nil
+}
+
+// online 判断用户是否在集群中的某个节点上
+func online(nick string) bool {
+	if users.with(nick, func(*user) {}) {
+		return true
+	}
+	_, ok := cluster.remote(nick)
+	return ok
+}
+
+func init() {
+	registerCommand(command{name: "/kick", usage: "/kick <user> [reason]", help: "disconnect a user", admin: true,
+		run: func(u *user, args string) {
+			a, err := parseModeration(args, 0)
+			if err != nil || !online(a.Target) {
+				u.notify("usage: /kick <user> [reason], the user must be online")
+				return
+			}
+			a.Action, a.Until = "kick", time.Time{}
+			moderate(u, a)
+		}})
+	registerCommand(command{name: "/mute", usage: "/mute <user> [time] [why]", help: "stop a user from talking, 10m by default", admin: true,
+		run: func(u *user, args string) {
+			a, err := parseModeration(args, defaultMute)
+			if err != nil || !validName.MatchString(a.Target) {
+				u.notify("usage: /mute <user> [duration] [reason]")
+				return
+			}
+			a.Action = "mute"
+			moderate(u, a)
+		}})
+	registerCommand(command{name: "/unmute", usage: "/unmute <user>", help: "let a muted user talk again", admin: true,
+		run: func(u *user, args string) {
+			if args == "" {
+				u.notify("usage: /unmute <user>")
+				return
+			}
+			moderate(u, modAction{Action: "unmute", Target: args})
+		}})
+	registerCommand(command{name: "/ban", usage: "/ban <user|ip> [time] [why]", help: "disconnect and ban a name and its IP, forever by default", admin: true,
+		run: func(u *user, args string) {
+			a, err := parseModeration(args, 0)
+			if err != nil || (!validName.MatchString(a.Target) && net.ParseIP(a.Target) == nil) {
+				u.notify("usage: /ban <user|ip> [duration] [reason]")
+				return
+			}
+			if strings.EqualFold(a.Target, u.nick) {
+				u.notify("you cannot ban yourself")
+				return
+			}
+			a.Action = "ban"
+			moderate(u, a)
+		}})
+	registerCommand(command{name: "/unban", usage: "/unban <user|ip>", help: "remove the bans of a name or an IP", admin: true,
+		run: func(u *user, args string) {
+			if args == "" {
+				u.notify("usage: /unban <user|ip>")
+				return
+			}
+			moderate(u, modAction{Action: "unban", Target: args})
+		}})
+	registerCommand(command{name: "/bans", usage: "/bans", help: "list the bans", admin: true,
+		run: func(u *user, args string) {
+			list := mod.list()
+			if len(list) == 0 {
+				u.notify("nobody is banned")
+				return
+			}
+			u.notify("bans:\n  " + strings.Join(list, "\n  "))
+		}})
+	registerFilter(func(u *user, m *message) bool {
+		if until, ok := mod.muted(u.nick); ok {
+			u.notify("you are muted until " + until.Format("2006-01-02 15:04:05"))
+			return false
+		}
+		return true
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 每个连接有一个monitor goroutine，处理三种需要断开连接的情况:
+//
+//	进程退出
+//	-idle 时间内没有任何输入，提前 -idle-warning 警告一次
+//	开启 -ping 时，连接安静超过 -ping 后发送 "PING <n>"，再过 -ping-timeout 仍没有任何数据就认为对端已经断开
+//
+// 客户端用 "/pong <n>" 回应心跳，心跳回应只证明连接还活着，不算作用户的输入。
+// 断开连接时只设置读超时，handleConn按正常离开的流程广播 "has left"。
+
+type monitor struct {
+	conn   net.Conn
+	out    chan<- string
+	f      *framer
+	seen   int64 // 最近一次收到数据的时间，UnixNano
+	active int64 // 最近一次收到用户输入(心跳回应以外)的时间
+}
+
+func newMonitor(conn net.Conn, out chan<- string, f *framer) *monitor {
+	now := time.Now().UnixNano()
+	return &monitor{conn: conn, out: out, f: f, seen: now, active: now}
+}
+
+// run 一直运行到ctx取消、done关闭或者断开连接为止
+func (m *monitor) run(ctx context.Context, done <-chan struct{}) {
+	ticker := time.NewTicker(monitorTick())
+	defer ticker.Stop()
+	warned := false
+	var pinged int64 // 对哪一次收到的数据之后的安静发过心跳
+	for {
+		select {
+		case <-ctx.Done():
+			m.conn.SetReadDeadline(time.Now())
+			return
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if *idleTimeout > 0 {
+				idle := now.Sub(time.Unix(0, atomic.LoadInt64(&m.active)))
+				switch {
+				case idle >= *idleTimeout:
+					m.out <- m.f.notice(fmt.Sprintf("*** disconnected after being idle for %v", *idleTimeout))
+					m.disconnect("idle")
+					return
+				case idle >= *idleTimeout-*idleWarning:
+					if !warned {
+						m.out <- m.f.notice(fmt.Sprintf("*** you have been idle for %v and will be disconnected in %v",
+							idle.Round(time.Second), (*idleTimeout - idle).Round(time.Second)))
+						warned = true
+					}
+				default:
+					warned = false
+				}
+			}
+			if *pingInterval > 0 {
+				seen := atomic.LoadInt64(&m.seen)
+				quiet := now.Sub(time.Unix(0, seen))
+				switch {
+				case quiet >= *pingInterval+*pingTimeout:
+					m.disconnect(fmt.Sprintf("no response to ping for %v", *pingTimeout))
+					return
+				case quiet >= *pingInterval && pinged != seen:
+					m.out <- m.f.encode(frame{Type: framePing, Text: strconv.FormatInt(now.Unix(), 10)})
+					pinged = seen
+				}
+			}
+		}
+	}
+}
+
+func (m *monitor) disconnect(reason string) {
+	log.Printf("disconnecting %s: %s", m.conn.RemoteAddr(), reason)
+	m.conn.SetReadDeadline(time.Now())
+}
+
+// monitorTick 是检查的间隔，足够精确又不会太频繁
+func monitorTick() time.Duration {
+	tick := time.Second
+	for _, d := range []time.Duration{*idleTimeout, *idleWarning, *pingInterval, *pingTimeout} {
+		if d > 0 && d/4 < tick {
+			tick = d / 4
+		}
+	}
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	return tick
+}
+
+// lineReader 按行读取输入，记录活动时间，跳过心跳回应并处理 /format。
+// JSON模式下的frame被转换成文本模式中等价的一行
+type lineReader struct {
+	*bufio.Scanner
+	m    *monitor
+	line string
+}
+
+func (r *lineReader) Scan() bool {
+	for r.Scanner.Scan() {
+		now := time.Now().UnixNano()
+		atomic.StoreInt64(&r.m.seen, now)
+		line, err := r.m.f.input(r.Scanner.Text())
+		if err != nil {
+			r.m.out <- r.m.f.notice(err.Error())
+			continue
+		}
+		if line == "/pong" || strings.HasPrefix(line, "/pong ") {
+			continue
+		}
+		atomic.StoreInt64(&r.m.active, now)
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "/format" {
+			r.m.out <- r.m.f.format(fields[1:])
+			continue
+		}
+		r.line = line
+		return true
+	}
+	return false
+}
+
+func (r *lineReader) Text() string {
+	return r.line
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// 插件是chat目录下的Go文件，在init中注册斜杠命令和消息过滤器，例如:
+//
+//	func init() {
+//		registerCommand(command{name: "/roll", usage: "/roll [n]", help: "roll an n-sided die", run: roll})
+//		registerFilter(func(u *user, m *message) bool { return !strings.Contains(m.Text, "spam") })
+//	}
+//
+// 命令和过滤器都在发出命令的用户自己的goroutine中执行，可以直接使用user的方法。
+// 管理命令(/kick、/ban、/mute等)也是这样实现的，见moderation.go。
+
+type command struct {
+	name  string // 包括开头的/
+	usage string
+	help  string
+	admin bool // 只有 -admins 中的用户可以使用
+	run   func(u *user, args string)
+}
+
+// messageFilter 在用户的消息发到房间或者作为私信发出之前按注册顺序调用，
+// 可以修改m.Text，返回false丢弃这条消息。私信的m.Room为空
+type messageFilter func(u *user, m *message) bool
+
+var (
+	commands = make(map[string]command)
+	filters  []messageFilter
+)
+
+// registerCommand 只能在init中调用，同名的命令会panic
+func registerCommand(c command) {
+	if !strings.HasPrefix(c.name, "/") || strings.ContainsAny(c.name, " \t") {
+		panic("chat: bad command name " + c.name)
+	}
+	if _, ok := commands[c.name]; ok {
+		panic("chat: command " + c.name + " registered twice")
+	}
+	commands[c.name] = c
+}
+
+// registerFilter 只能在init中调用
+func registerFilter(f messageFilter) {
+	filters = append(filters, f)
+}
+
+// filter 依次执行所有过滤器，返回false表示消息被丢弃
+func filter(u *user, m *message) bool {
+	for _, f := range filters {
+		if !f(u, m) {
+			return false
+		}
+	}
+	return true
+}
+
+// runCommand 执行插件命令，没有这个命令时返回false
+func (u *user) runCommand(line string) bool {
+	name, args := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		name, args = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	c, ok := commands[name]
+	if !ok {
+		return false
+	}
+	if c.admin && !isAdmin(u.nick) {
+		u.notify(name + " is only for admins")
+		return true
+	}
+	c.run(u, args)
+	return true
+}
+
+// helpText 返回内置命令和插件命令的说明，管理命令只对管理员显示
+func (u *user) helpText() string {
+	names := make([]string, 0, len(commands))
+	for name, c := range commands {
+		if !c.admin || isAdmin(u.nick) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(help)
+	for _, name := range names {
+		c := commands[name]
+		fmt.Fprintf(&b, "\n  %-20s %s", c.usage, c.help)
+	}
+	b.WriteString("\n" + helpNotes)
+	return b.String()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// 随chat一起提供的插件，也是写插件的例子，插件的接口见plugin.go
+
+var blockedWords = flag.String("blocked-words", "", "comma-separated words masked with * in messages")
+
+func init() {
+	registerCommand(command{name: "/me", usage: "/me <action>", help: "describe what you are doing", run: me})
+	registerFilter(maskWords)
+}
+
+func me(u *user, args string) {
+	if args == "" {
+		u.notify("usage: /me <action>")
+		return
+	}
+	u.say(u.current, "* "+args)
+}
+
+var (
+	blockedOnce sync.Once
+	blocked     *regexp.Regexp // 没有 -blocked-words 时为nil
+)
+
+// maskWords 把 -blocked-words 中的词换成同样长度的*，不区分大小写
+func maskWords(u *user, m *message) bool {
+	blockedOnce.Do(func() {
+		var words []string
+		for _, w := range splitList(*blockedWords) {
+			words = append(words, regexp.QuoteMeta(w))
+		}
+		if len(words) > 0 {
+			blocked = regexp.MustCompile(`(?i)\b(` + strings.Join(words, "|") + `)\b`)
+		}
+	})
+	if blocked != nil {
+		m.Text = blocked.ReplaceAllStringFunc(m.Text, func(w string) string {
+			return strings.Repeat("*", len(w))
+		})
+	}
+	return true
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// 每个客户端在client channel和clientWriter之间有一个有界的发送队列。
+// 队列goroutine总是能立即接收消息，broadcaster往client channel发送时不会被慢客户端卡住；
+// 队列满时按 -overflow 处理:
+//
+//	drop-oldest 丢弃队列中最旧的消息
+//	drop-new    丢弃新到的消息
+//	disconnect  断开这个客户端
+//
+// 写连接超过 -write-timeout 没有完成的客户端会被断开。
+
+const (
+	dropOldest = "drop-oldest"
+	dropNew    = "drop-new"
+	disconnect = "disconnect"
+)
+
+var (
+	droppedMessages = expvar.NewInt("chat_dropped_messages")
+	evictedClients  = expvar.NewInt("chat_evicted_clients")
+)
+
+// evictor 断开一个客户端，只在第一次调用时生效
+type evictor struct {
+	addr string
+	c    io.Closer
+	once sync.Once
+}
+
+func (e *evictor) evict(reason string) {
+	e.once.Do(func() {
+		log.Printf("evicting %s: %s", e.addr, reason)
+		evictedClients.Add(1)
+		e.c.Close()
+	})
+}
+
+// queue 把in中的消息转发给out，in关闭后把剩余的消息发完再关闭out
+func queue(in <-chan string, out chan<- string, ev *evictor, f *framer) {
+	var (
+		pending []string
+		lost    int // 上次通知以后丢弃的消息数
+	)
+	for in != nil || len(pending) > 0 {
+		var (
+			send chan<- string
+			next string
+		)
+		if len(pending) > 0 {
+			send, next = out, pending[0]
+		}
+		select {
+		case msg, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			if len(pending) < *queueSize && lost > 0 {
+				pending = append(pending, f.notice(fmt.Sprintf("*** %d messages dropped, your connection is too slow", lost)))
+				lost = 0
+			}
+			if len(pending) < *queueSize {
+				pending = append(pending, msg)
+				continue
+			}
+			droppedMessages.Add(1)
+			switch *overflow {
+			case dropOldest:
+				pending = append(pending[1:], msg)
+				lost++
+			case dropNew:
+				lost++
+			default:
+				ev.evict(fmt.Sprintf("outbound queue full (%d messages)", *queueSize))
+			}
+		case send <- next:
+			pending = pending[1:]
+		}
+	}
+	close(out)
+}
+
+// clientWriter 把消息写到连接。写出错以后继续读取ch直到关闭，
+// 保证queue不会阻塞
+func clientWriter(conn net.Conn, ch <-chan string, ev *evictor) {
+	var err error
+	for msg := range ch {
+		if err != nil {
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(*writeTimeout))
+		if _, err = fmt.Fprintln(conn, msg); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				ev.evict(fmt.Sprintf("write stalled for %v", *writeTimeout))
+			}
+		}
+	}
+}
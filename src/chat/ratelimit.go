@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// 每个用户输入的行(消息和命令)受令牌桶限制: 平均每秒 -rate 行，最多连续 -burst 行。
+// 超出的行被丢弃，每秒最多提示一次；连续丢弃 -flood-kick 行以后断开连接。
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow(now time.Time, rate float64, burst int) bool {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > float64(burst) {
+			b.tokens = float64(burst)
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// throttle 判断这一行是否可以处理，只在用户自己的goroutine中调用
+func (u *user) throttle() bool {
+	if *lineRate <= 0 {
+		return true
+	}
+	now := time.Now()
+	if u.bucket.allow(now, *lineRate, *lineBurst) {
+		u.dropped = 0
+		return true
+	}
+	u.dropped++
+	if *floodKick > 0 && u.dropped == *floodKick {
+		u.notify(fmt.Sprintf("*** disconnected for flooding (%d lines dropped)", u.dropped))
+		u.disconnect("flooding")
+		return false
+	}
+	if now.Sub(u.warned) >= time.Second {
+		u.notify(fmt.Sprintf("*** slow down, at most %g lines per second, your input is being dropped", *lineRate))
+		u.warned = now
+	}
+	return false
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// message 是房间里广播的一条消息，From为空表示系统消息(加入、离开、改名)
+type message struct {
+	ID   string    `json:"id,omitempty"`
+	Time time.Time `json:"time"`
+	Room string    `json:"room"`
+	From string    `json:"from,omitempty"`
+	Text string    `json:"text"`
+}
+
+func (m message) frame() frame {
+	typ := frameMessage
+	if m.From == "" {
+		typ = frameEvent
+	}
+	return frame{Type: typ, ID: m.ID, Room: m.Room, From: m.From, Text: m.Text, Time: m.Time}
+}
+
+// join 是一次加入房间的请求，replay 说明加入时要回放哪些历史消息
+type join struct {
+	u      *user
+	replay replay
+}
+
+// room 是一个聊天房间。成员的加入、离开和消息广播都由房间自己的broadcaster goroutine串行处理
+type room struct {
+	name     string
+	history  *history // nil表示不保存历史消息
+	entering chan join
+	leaving  chan *user
+	renaming chan rename
+	messages chan message // all incoming messages of this room
+	remote   chan message // 其它节点转发来的消息
+	who      chan chan []string
+	refs     int           // 本节点上持有这个房间的用户数，由rooms.mu保护
+	done     chan struct{} // 房间被移除时关闭，broadcaster随之退出
+}
+
+type rename struct {
+	from, to string
+}
+
+// broadcaster监听entering和leaving的channel来获知成员的加入和离开事件并更新成员集合，
+// 同时把messages中的消息写入历史记录并发送给所有成员的消息发出channel。
+// 新成员先收到回放的历史消息，再加入成员集合，不会漏掉或重复收到消息。
+// 本节点产生的消息和成员变化同时发给集群，其它节点的消息从remote到达，只发给本节点的成员。
+// 成员的channel由handleConn在离开所有房间以后关闭。
+// 房间被移除时所有成员都已经离开，broadcaster关闭历史记录后退出。
+func (r *room) broadcaster() {
+	members := make(map[*user]bool) // all members in the room
+	deliver := func(m message) {
+		if err := r.history.append(m); err != nil {
+			log.Printf("room %s: %v", r.name, err)
+		}
+		// Broadcast incoming message to all
+		// members' outgoing message channels.
+		for u := range members {
+			u.out <- u.f.encode(m.frame())
+		}
+	}
+	broadcast := func(m message) *message {
+		m.ID = newMessageID()
+		m.Time = time.Now()
+		m.Room = r.name
+		deliver(m)
+		return &m
+	}
+	for {
+		select {
+		case m := <-r.messages:
+			msg := broadcast(m)
+			cluster.publish(busEvent{ID: msg.ID, Type: evMessage, Room: r.name, Msg: msg})
+		case m := <-r.remote:
+			deliver(m)
+		case j := <-r.entering:
+			r.replay(j.u, j.replay)
+			name := j.u.name()
+			msg := broadcast(message{Text: name + " has arrived"})
+			members[j.u] = true
+			cluster.publish(busEvent{ID: msg.ID, Type: evJoin, Room: r.name, Nick: name, Msg: msg})
+		case u := <-r.leaving:
+			delete(members, u)
+			name := u.name()
+			msg := broadcast(message{Text: name + " has left"})
+			cluster.publish(busEvent{ID: msg.ID, Type: evLeave, Room: r.name, Nick: name, Msg: msg})
+		case rn := <-r.renaming:
+			msg := broadcast(message{Text: rn.from + " is now known as " + rn.to})
+			cluster.publish(busEvent{ID: msg.ID, Type: evRename, Room: r.name, Nick: rn.from, To: rn.to, Msg: msg})
+		case reply := <-r.who:
+			names := make([]string, 0, len(members))
+			for u := range members {
+				names = append(names, u.name())
+			}
+			reply <- names
+		case <-r.done:
+			if err := r.history.close(); err != nil {
+				log.Printf("room %s: %v", r.name, err)
+			}
+			return
+		}
+	}
+}
+
+func (r *room) replay(u *user, rp replay) {
+	msgs, err := rp.read(r.history)
+	if err != nil {
+		log.Printf("room %s: %v", r.name, err)
+		return
+	}
+	if len(msgs) == 0 {
+		return
+	}
+	u.notify(fmt.Sprintf("--- %d earlier messages in %s ---", len(msgs), r.name))
+	for _, m := range msgs {
+		u.showHistory(m)
+	}
+	u.notify("--- end of history ---")
+}
+
+// members 返回房间内所有成员的昵称，其它节点上的成员带有 "@节点名"
+func (r *room) members() []string {
+	var names []string
+	reply := make(chan []string)
+	select {
+	case r.who <- reply:
+		names = <-reply
+	case <-r.done:
+		// lookup以后房间刚好被移除，本节点已经没有成员
+	}
+	names = append(names, cluster.members(r.name)...)
+	sort.Strings(names)
+	return names
+}
+
+// roomSet 按名字索引所有房间。房间在第一次加入时创建，本节点的最后一个成员离开时移除(大厅除外)，
+// 随便起名字的房间不会一直占着goroutine和历史记录文件
+type roomSet struct {
+	dir    string // 历史消息目录，为空时不保存
+	mu     sync.Mutex
+	byName map[string]*room
+}
+
+func newRoomSet(dir string) *roomSet {
+	return &roomSet{dir: dir, byName: make(map[string]*room)}
+}
+
+// get 返回房间并增加它的引用计数，不存在时创建。不再使用时调用release
+func (s *roomSet) get(name string) *room {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.byName[name]
+	if !ok {
+		r = &room{
+			name:     name,
+			entering: make(chan join),
+			leaving:  make(chan *user),
+			renaming: make(chan rename),
+			messages: make(chan message),
+			remote:   make(chan message),
+			who:      make(chan chan []string),
+			done:     make(chan struct{}),
+		}
+		if s.dir != "" {
+			h, err := openHistory(filepath.Join(s.dir, name+".log"))
+			if err != nil {
+				// 历史记录坏了不影响聊天
+				log.Printf("room %s: history disabled: %v", name, err)
+			}
+			r.history = h
+		}
+		s.byName[name] = r
+		go r.broadcaster()
+	}
+	r.refs++
+	return r
+}
+
+// release 释放get增加的引用，最后一个引用释放时移除房间
+func (s *roomSet) release(r *room) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.refs--
+	if r.refs == 0 && r.name != *lobby {
+		delete(s.byName, r.name)
+		close(r.done)
+	}
+}
+
+// deliver 把其它节点的消息交给房间。本节点没有人在这个房间时不创建房间，只追加到历史记录
+func (s *roomSet) deliver(m message) {
+	s.mu.Lock()
+	r, ok := s.byName[m.Room]
+	if ok {
+		r.refs++
+	} else if s.dir != "" {
+		// 持有锁写入，同一个房间这时不会被get打开
+		if err := appendHistory(filepath.Join(s.dir, m.Room+".log"), m); err != nil {
+			log.Printf("room %s: %v", m.Room, err)
+		}
+	}
+	s.mu.Unlock()
+	if ok {
+		r.remote <- m
+		s.release(r)
+	}
+}
+
+func (s *roomSet) lookup(name string) (*room, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.byName[name]
+	return r, ok
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errInvalidName = errors.New("names must be 1-32 letters, digits, '_' or '-'")
+	errNickTaken   = errors.New("nickname is already taken")
+	errNoSuchUser  = errors.New("no such user")
+
+	validName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+)
+
+// bannedError 表示昵称或者IP被封禁，until为零值时是永久封禁
+type bannedError struct {
+	until time.Time
+}
+
+func (e bannedError) Error() string {
+	if e.until.IsZero() {
+		return "you are banned"
+	}
+	return "you are banned until " + e.until.Format("2006-01-02 15:04:05")
+}
+
+// mutedError 表示用户被禁言，禁言期间不能改名，否则换个昵称就绕过了禁言
+type mutedError struct {
+	until time.Time
+}
+
+func (e mutedError) Error() string {
+	return "you are muted until " + e.until.Format("2006-01-02 15:04:05") + ", you cannot change your nickname"
+}
+
+// user 是一个已经完成握手的客户端。
+// rooms、current和限速的状态只由该用户自己的handleConn goroutine访问
+type user struct {
+	nick       string // 只在持有users.mu时修改
+	addr       string
+	out        client
+	f          *framer
+	disconnect func(reason string) // 让连接按正常离开的流程断开，不能阻塞
+	rooms      map[string]*room
+	current    *room // 不带命令的输入发送到这个房间
+
+	bucket  tokenBucket
+	dropped int // 连续被限速丢弃的行数
+	warned  time.Time
+}
+
+func newUser(addr string, out client, f *framer, disconnect func(reason string)) *user {
+	return &user{addr: addr, out: out, f: f, disconnect: disconnect, rooms: make(map[string]*room)}
+}
+
+// userSet 按昵称索引在线用户，昵称不区分大小写
+type userSet struct {
+	mu     sync.Mutex
+	byNick map[string]*user
+}
+
+var users = &userSet{byNick: make(map[string]*user)}
+
+// register 用nick注册u，被封禁的昵称和IP不能注册
+func (s *userSet) register(u *user, nick string) error {
+	nick = strings.TrimSpace(nick)
+	if !validName.MatchString(nick) {
+		return errInvalidName
+	}
+	if b, ok := mod.banned(nick, hostOf(u.addr)); ok {
+		return bannedError{b.Until}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.ToLower(nick)
+	if _, ok := s.byNick[key]; ok {
+		return errNickTaken
+	}
+	if _, ok := cluster.remote(nick); ok {
+		return errNickTaken
+	}
+	u.nick = nick
+	s.byNick[key] = u
+	cluster.publish(busEvent{Type: evOnline, Nick: nick})
+	return nil
+}
+
+func (s *userSet) rename(u *user, nick string) error {
+	if !validName.MatchString(nick) {
+		return errInvalidName
+	}
+	if b, ok := mod.banned(nick, ""); ok {
+		return bannedError{b.Until}
+	}
+	if until, ok := mod.muted(u.nick); ok {
+		return mutedError{until}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.ToLower(nick)
+	if other, ok := s.byNick[key]; ok && other != u {
+		return errNickTaken
+	}
+	if _, ok := cluster.remote(nick); ok {
+		return errNickTaken
+	}
+	delete(s.byNick, strings.ToLower(u.nick))
+	s.byNick[key] = u
+	cluster.publish(busEvent{Type: evOffline, Nick: u.nick})
+	cluster.publish(busEvent{Type: evOnline, Nick: nick})
+	u.nick = nick
+	return nil
+}
+
+func (s *userSet) remove(u *user) {
+	s.mu.Lock()
+	delete(s.byNick, strings.ToLower(u.nick))
+	cluster.publish(busEvent{Type: evOffline, Nick: u.nick})
+	s.mu.Unlock()
+}
+
+// send 给指定用户发送一条私信。
+// 持有锁发送，保证用户注销(之后关闭channel)以前的消息不会发到已关闭的channel
+func (s *userSet) send(nick, from, text string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.byNick[strings.ToLower(nick)]
+	if !ok {
+		return errNoSuchUser
+	}
+	u.out <- u.f.encode(frame{Type: framePrivate, ID: newMessageID(), From: from, Text: text})
+	return nil
+}
+
+// with 持有锁对指定的用户调用f，用户不在线时返回false。f中可以安全地往u.out发送
+func (s *userSet) with(nick string, f func(u *user)) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.byNick[strings.ToLower(nick)]
+	if ok {
+		f(u)
+	}
+	return ok
+}
+
+func (s *userSet) notifyAll(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.byNick {
+		u.notify(msg)
+	}
+}
+
+// name 返回用户当前的昵称，供其它goroutine使用
+func (u *user) name() string {
+	users.mu.Lock()
+	defer users.mu.Unlock()
+	return u.nick
+}
+
+func (u *user) notify(msg string) {
+	u.out <- u.f.notice(msg)
+}
+
+// showHistory 发送一条回放的历史消息
+func (u *user) showHistory(m message) {
+	fr := m.frame()
+	fr.History = true
+	u.out <- u.f.encode(fr)
+}
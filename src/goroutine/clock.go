@@ -1,34 +1,337 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"go-practice/src/lifecycle"
 )
 
-func main(){
-	listener, err := net.Listen("tcp", "localhost:8000")
+// clock 每隔一段时间向客户端发送当前时间，用 nc localhost 8000 就可以看到。
+// 客户端连接后可以在 -handshake 时间内发送一行设置，空格分隔的 key=value:
+//
+//	format=rfc3339 tz=Asia/Shanghai tick=500ms
+//	format=unixmilli
+//	tz=UTC layout=2006-01-02 15:04:05.000     layout是Go的自定义格式，占用这一行剩下的部分
+//	mode=ntp
+//
+// format 可以是 time(默认，15:04:05)、rfc3339、rfc3339nano、kitchen、unix、unixmilli、unixnano，
+// tz 是IANA时区名或者Local(默认)。发送了设置的客户端先收到一行 "OK <设置>"，设置有错时收到 "ERR <原因>" 后连接关闭；
+// 什么都不发送或者发送空行的客户端使用默认设置。时间按tick对齐发送，比如tick=1s时在每秒的开始。
+//
+// 设置和请求每行最多1024字节(maxLine)，更长的行收到 "ERR line too long" 后连接关闭。
+//
+// mode=ntp 时服务器不主动发送，客户端每发送一行 "<t0>" 服务器回复一行 "<t0> <t1> <t2>"，
+// t1和t2是服务器收到请求和发出回复的Unix纳秒。t0原样返回，通常是客户端发送时的Unix纳秒，
+// 客户端记下收到回复的时间t3以后可以算出:
+//
+//	时钟偏差 offset = ((t1-t0) + (t2-t3)) / 2
+//	往返延迟 delay  = (t3-t0) - (t2-t1)
+//
+// 超过 -ntp-idle 没有发送请求的ntp客户端会被断开。
+//
+// 同时最多服务 -max-conns 个连接，超出的连接收到一行 "BUSY ..." 后被关闭，不会为它们启动goroutine。
+// 连接数在 -health 地址的 /debug/vars 中:
+//
+//	clock_active_connections    正在服务的连接，也就是handleConn goroutine的个数
+//	clock_connections_total     接受过的连接
+//	clock_rejected_connections  因为超出上限被拒绝的连接
+
+var (
+	addr      = flag.String("addr", "localhost:8000", "listen address")
+	tick      = flag.Duration("tick", time.Second, "default interval between times sent to a client")
+	minTick   = flag.Duration("min-tick", 10*time.Millisecond, "smallest tick a client may ask for")
+	handshake = flag.Duration("handshake", 500*time.Millisecond, "how long to wait for a client's settings line")
+	ntpIdle   = flag.Duration("ntp-idle", time.Minute, "close ntp clients that send no request for this long")
+	maxConns  = flag.Int("max-conns", 256, "clients served at the same time, others are told the server is busy")
+	drain     = flag.Duration("drain", 5*time.Second, "time to wait for clients on shutdown")
+	health    = flag.String("health", "", "address for /healthz, /readyz and /debug/vars, empty to disable")
+)
+
+var (
+	activeConns   = expvar.NewInt("clock_active_connections")
+	totalConns    = expvar.NewInt("clock_connections_total")
+	rejectedConns = expvar.NewInt("clock_rejected_connections")
+)
+
+const (
+	maxToken = 64   // ntp模式下t0的最大长度
+	maxLine  = 1024 // 客户端发送的一行的最大长度，也是读缓冲区的大小
+)
+
+var errLineTooLong = errors.New("line too long")
+
+var formats = map[string]func(t time.Time) string{
+	"time":        func(t time.Time) string { return t.Format("15:04:05") },
+	"rfc3339":     func(t time.Time) string { return t.Format(time.RFC3339) },
+	"rfc3339nano": func(t time.Time) string { return t.Format(time.RFC3339Nano) },
+	"kitchen":     func(t time.Time) string { return t.Format(time.Kitchen) },
+	"unix":        func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) },
+	"unixmilli":   func(t time.Time) string { return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10) },
+	"unixnano":    func(t time.Time) string { return strconv.FormatInt(t.UnixNano(), 10) },
+}
+
+// clockConfig 是一个连接的设置
+type clockConfig struct {
+	format string
+	layout string // 不为空时使用自定义格式
+	tz     string
+	loc    *time.Location
+	tick   time.Duration
+	ntp    bool
+}
+
+func defaultConfig() clockConfig {
+	return clockConfig{format: "time", tz: "Local", loc: time.Local, tick: *tick}
+}
+
+// parseConfig 解析客户端发送的设置行
+func parseConfig(line string) (clockConfig, error) {
+	cfg := defaultConfig()
+	for line != "" {
+		var field string
+		if strings.HasPrefix(line, "layout=") {
+			field, line = line, ""
+		} else if i := strings.IndexByte(line, ' '); i >= 0 {
+			field, line = line[:i], strings.TrimLeft(line[i+1:], " ")
+		} else {
+			field, line = line, ""
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return cfg, fmt.Errorf("want key=value, got %q", field)
+		}
+		switch key, value := kv[0], kv[1]; key {
+		case "format":
+			if _, ok := formats[value]; !ok {
+				return cfg, fmt.Errorf("unknown format %q", value)
+			}
+			cfg.format = value
+		case "layout":
+			if value == "" {
+				return cfg, errors.New("empty layout")
+			}
+			cfg.layout = value
+		case "tz":
+			loc, err := time.LoadLocation(value)
+			if err != nil {
+				return cfg, fmt.Errorf("unknown time zone %q", value)
+			}
+			cfg.tz, cfg.loc = value, loc
+		case "tick":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < *minTick {
+				return cfg, fmt.Errorf("tick must be a duration of at least %v", *minTick)
+			}
+			cfg.tick = d
+		case "mode":
+			switch value {
+			case "tick":
+				cfg.ntp = false
+			case "ntp":
+				cfg.ntp = true
+			default:
+				return cfg, fmt.Errorf("unknown mode %q", value)
+			}
+		default:
+			return cfg, fmt.Errorf("unknown setting %q", key)
+		}
+	}
+	return cfg, nil
+}
+
+func (c clockConfig) String() string {
+	if c.ntp {
+		return "mode=ntp"
+	}
+	s := fmt.Sprintf("format=%s tz=%s tick=%v", c.format, c.tz, c.tick)
+	if c.layout != "" {
+		s = fmt.Sprintf("tz=%s tick=%v layout=%s", c.tz, c.tick, c.layout)
+	}
+	return s
+}
+
+func (c clockConfig) formatTime(t time.Time) string {
+	t = t.In(c.loc)
+	if c.layout != "" {
+		return t.Format(c.layout)
+	}
+	return formats[c.format](t)
+}
+
+func main() {
+	flag.Parse()
+	if *tick < *minTick {
+		log.Fatalf("-tick must be at least -min-tick (%v)", *minTick)
+	}
+	if *maxConns <= 0 {
+		log.Fatal("-max-conns must be positive")
+	}
+	lc := lifecycle.New(*drain)
+	ln, err := net.Listen("tcp", *addr)
 	if err != nil {
 		log.Fatal(err)
 	}
-	for{
-		conn, err := listener.Accept()
+	if *health != "" {
+		// expvar把连接计数注册在 /debug/vars
+		lc.RegisterHealth(http.DefaultServeMux)
+		go func() {
+			log.Printf("health: %v", http.ListenAndServe(*health, nil))
+		}()
+	}
+	listener := &limitListener{Listener: ln, sem: make(chan struct{}, *maxConns)}
+	if err := lc.Serve(listener, handleConn); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// limitListener 只返回拿到令牌的连接，令牌在连接关闭时归还。
+// 令牌是sem中的一个位置，拿不到令牌的连接在Accept中直接回复busy并关闭
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
 		if err != nil {
-			log.Print(err)
-			continue
+			return nil, err
+		}
+		totalConns.Add(1)
+		select {
+		case l.sem <- struct{}{}:
+			activeConns.Add(1)
+			return &limitConn{Conn: c, sem: l.sem}, nil
+		default:
 		}
-		go handleConn(conn)
+		rejectedConns.Add(1)
+		// 新连接的发送缓冲区是空的，这一行不会阻塞，设置超时只是以防万一
+		c.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+		fmt.Fprintf(c, "BUSY %d clients connected, try again later\n", cap(l.sem))
+		c.Close()
 	}
 }
 
-func handleConn(c net.Conn){
+type limitConn struct {
+	net.Conn
+	sem  chan struct{}
+	once sync.Once
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		<-c.sem
+		activeConns.Add(-1)
+	})
+	return err
+}
+
+func handleConn(ctx context.Context, c net.Conn) {
 	defer c.Close()
-	for{
-		_, err := io.WriteString(c, time.Now().Format("11:01:01\n"))
+	cfg := defaultConfig()
+	input := bufio.NewReaderSize(c, maxLine)
+	c.SetReadDeadline(time.Now().Add(*handshake))
+	line, err := readLine(input)
+	c.SetReadDeadline(time.Time{})
+	if err == errLineTooLong {
+		fmt.Fprintf(c, "ERR %v\n", err)
+		return
+	}
+	if ne, ok := err.(net.Error); err != nil && err != io.EOF && !(ok && ne.Timeout()) {
+		return
+	}
+	// 超时或者对方关闭了写的一端都按没有设置处理
+	if line = strings.TrimSpace(line); err == nil && line != "" {
+		if cfg, err = parseConfig(line); err != nil {
+			fmt.Fprintf(c, "ERR %v\n", err)
+			return
+		}
+		if _, err := fmt.Fprintf(c, "OK %s\n", cfg); err != nil {
+			return
+		}
+	}
+	if cfg.ntp {
+		serveNTP(ctx, c, input)
+		return
+	}
+	sendTicks(ctx, c, cfg)
+}
+
+// sendTicks 立即发送一次，之后对齐到tick的整数倍发送
+func sendTicks(ctx context.Context, c net.Conn, cfg clockConfig) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case now := <-timer.C:
+			if _, err := io.WriteString(c, cfg.formatTime(now)+"\n"); err != nil {
+				return
+			}
+			now = time.Now()
+			timer.Reset(now.Truncate(cfg.tick).Add(cfg.tick).Sub(now))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readLine 读取一行，一行超过缓冲区大小时返回errLineTooLong，不会为一行无限地分配内存
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errLineTooLong
+	}
+	return string(line), err
+}
+
+// serveNTP 回应客户端的时间请求，直到客户端断开、超过 -ntp-idle 没有请求或者进程退出
+func serveNTP(ctx context.Context, c net.Conn, input *bufio.Reader) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	for {
+		c.SetReadDeadline(time.Now().Add(*ntpIdle))
+		// 进程退出时上面的goroutine设置的deadline可能刚被覆盖
+		if ctx.Err() != nil {
+			return
+		}
+		line, err := readLine(input)
+		t1 := time.Now()
+		if err == errLineTooLong {
+			fmt.Fprintf(c, "ERR %v\n", err)
+			return
+		}
 		if err != nil {
 			return
 		}
-		time.Sleep(1 * time.Second)
+		t0 := strings.TrimSpace(line)
+		if t0 == "" || len(t0) > maxToken || strings.ContainsAny(t0, " \t") {
+			fmt.Fprintf(c, "ERR want one token of at most %d bytes\n", maxToken)
+			continue
+		}
+		t2 := time.Now()
+		if _, err := fmt.Fprintf(c, "%s %d %d\n", t0, t1.UnixNano(), t2.UnixNano()); err != nil {
+			return
+		}
 	}
-}
\ No newline at end of file
+}
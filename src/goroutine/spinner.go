@@ -1,30 +1,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"time"
+
+	"go-practice/src/progress"
 )
 
-func main(){
-	go spinner(300 * time.Millisecond)
+// 计算期间显示spinner，算完以后Stop让显示的goroutine退出，再输出结果
+func main() {
+	spinner := progress.NewSpinner("fib").Start(context.Background())
 	const n = 45
 	fibN := fib(n)
-	fmt.Printf("\rFibonacci(%d) = %d\n", n, fibN)
-}
-
-func spinner(delay time.Duration){
-	strs := []string{".","..","...","....",".....","....."}
-	for{
-		for _, s:= range strs {
-			fmt.Printf("\r%s", s)
-			time.Sleep(delay)
-		}
-	}
+	spinner.Stop()
+	fmt.Printf("Fibonacci(%d) = %d\n", n, fibN)
 }
 
 func fib(x int) int {
 	if x < 2 {
 		return x
 	}
-	return fib(x - 1) + fib(x - 2)
-}
\ No newline at end of file
+	return fib(x-1) + fib(x-2)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// influxrecv 是本地测试用的InfluxDB v2写入接口替身，src/web可以用 -influx-url 指向它:
+//
+//	go run main.go -addr :8086 -output points.lp
+//	web -influx-url http://localhost:8086 -influx-org test -influx-token secret
+//
+// 收到的body用vendor的 models.ParsePoints 解析，格式不对时像InfluxDB一样返回400，
+// 解析成功的point按line protocol追加到输出文件
+
+var (
+	addr   = flag.String("addr", ":8086", "listen address")
+	output = flag.String("output", "-", "file points are appended to, - for stdout")
+	token  = flag.String("token", "", "require Authorization: Token <token> if set")
+)
+
+func main() {
+	flag.Parse()
+	out := os.Stdout
+	if *output != "-" {
+		f, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	var mu sync.Mutex
+	http.HandleFunc("/api/v2/write", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if *token != "" && r.Header.Get("Authorization") != "Token "+*token {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("bucket") == "" {
+			http.Error(w, "bucket is required", http.StatusBadRequest)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		points, err := models.ParsePoints(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var buf []byte
+		for _, p := range points {
+			buf = append(p.AppendString(buf), '\n')
+		}
+		mu.Lock()
+		_, err = out.Write(buf)
+		mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("%d points from %s", len(points), r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
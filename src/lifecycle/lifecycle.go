@@ -0,0 +1,234 @@
+// Package lifecycle 管理服务进程从启动到退出的过程:
+// 收到SIGINT/SIGTERM后取消Context，readiness变为未就绪，停止接受新连接，
+// 等待处理中的请求和连接结束，超过drain时间后强制关闭。
+//
+//	lc := lifecycle.New(10 * time.Second)
+//	lc.RegisterHealth(http.DefaultServeMux)
+//	if err := lc.ListenAndServe(&http.Server{Addr: ":9090"}); err != nil {
+//		log.Print(err)
+//	}
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrDrainTimeout 表示drain时间内还有连接没有结束，这些连接已被强制关闭
+var ErrDrainTimeout = errors.New("lifecycle: drain deadline exceeded, remaining connections closed")
+
+type Lifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	drain  time.Duration
+	ready  int32
+}
+
+// New 返回一个Lifecycle并开始监听SIGINT和SIGTERM。
+// 第一次收到信号时开始优雅退出，第二次收到时立即退出进程
+func New(drain time.Duration) *Lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Lifecycle{ctx: ctx, cancel: cancel, drain: drain}
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case s := <-sig:
+			log.Printf("received %v, shutting down (draining up to %v)", s, drain)
+			l.Shutdown()
+		case <-ctx.Done():
+		}
+		s := <-sig
+		log.Printf("received %v again, exiting", s)
+		os.Exit(1)
+	}()
+	return l
+}
+
+// Context 在进程开始退出时被取消
+func (l *Lifecycle) Context() context.Context {
+	return l.ctx
+}
+
+// Shutdown 开始优雅退出，可以重复调用
+func (l *Lifecycle) Shutdown() {
+	l.SetReady(false)
+	l.cancel()
+}
+
+// SetReady 设置readiness，ListenAndServe和Serve开始监听后会自动设为就绪
+func (l *Lifecycle) SetReady(ready bool) {
+	var v int32
+	if ready && l.ctx.Err() == nil {
+		v = 1
+	}
+	atomic.StoreInt32(&l.ready, v)
+}
+
+func (l *Lifecycle) Ready() bool {
+	return atomic.LoadInt32(&l.ready) == 1
+}
+
+// RegisterHealth 注册两个探活接口:
+//
+//	/healthz 进程存活即返回200
+//	/readyz  就绪时返回200，启动中或正在退出时返回503
+func (l *Lifecycle) RegisterHealth(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case l.ctx.Err() != nil:
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		case !l.Ready():
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+		default:
+			fmt.Fprintln(w, "ok")
+		}
+	})
+}
+
+// ServeHealth 在单独的地址上提供探活接口，给不是HTTP协议的服务使用。
+// 探活服务一直运行到进程退出，这样退出过程中 /readyz 也能返回503
+func (l *Lifecycle) ServeHealth(addr string) {
+	mux := http.NewServeMux()
+	l.RegisterHealth(mux)
+	go func() {
+		log.Printf("health: %v", http.ListenAndServe(addr, mux))
+	}()
+}
+
+// ListenAndServe 启动srv并阻塞到退出，srv.TLSConfig不为空时使用HTTPS。Context取消后停止接受新连接，
+// 等待处理中的请求完成，超过drain时间后关闭剩余连接并返回ErrDrainTimeout
+func (l *Lifecycle) ListenAndServe(srv *http.Server) error {
+	addr := srv.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	l.SetReady(true)
+	errc := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			errc <- srv.ServeTLS(ln, "", "")
+		} else {
+			errc <- srv.Serve(ln)
+		}
+	}()
+	select {
+	case err := <-errc:
+		l.Shutdown()
+		return err
+	case <-l.ctx.Done():
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), l.drain)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		<-errc
+		return ErrDrainTimeout
+	}
+	<-errc
+	return nil
+}
+
+// ConnHandler 处理一个TCP连接。ctx在进程开始退出时被取消，
+// handler应当尽快收尾并返回，关闭conn由handler负责
+type ConnHandler func(ctx context.Context, conn net.Conn)
+
+// Serve 在ln上接受连接并为每个连接启动一个goroutine执行handle，阻塞到退出。
+// Accept临时出错(比如文件描述符用完)时从5ms开始加倍等待，最多1s。
+// Context取消后关闭ln，等待所有handler返回，超过drain时间后强制关闭剩余连接
+func (l *Lifecycle) Serve(ln net.Listener, handle ConnHandler) error {
+	l.SetReady(true)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-l.ctx.Done():
+			ln.Close()
+		case <-stop:
+		}
+	}()
+
+	var (
+		mu    sync.Mutex
+		conns = make(map[net.Conn]struct{})
+		wg    sync.WaitGroup
+		err   error
+		delay time.Duration // Accept出错以后的等待时间
+	)
+	for {
+		conn, aerr := ln.Accept()
+		if aerr != nil {
+			if l.ctx.Err() != nil {
+				break
+			}
+			if ne, ok := aerr.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Printf("accept: %v, retrying in %v", aerr, delay)
+				select {
+				case <-time.After(delay):
+				case <-l.ctx.Done():
+				}
+				continue
+			}
+			err = aerr
+			l.Shutdown()
+			break
+		}
+		delay = 0
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handle(l.ctx, conn)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-time.After(l.drain):
+	}
+	mu.Lock()
+	n := len(conns)
+	for conn := range conns {
+		conn.Close()
+	}
+	mu.Unlock()
+	log.Printf("closed %d connections after %v", n, l.drain)
+	<-done
+	if err == nil {
+		err = ErrDrainTimeout
+	}
+	return err
+}
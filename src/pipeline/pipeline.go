@@ -0,0 +1,327 @@
+// Package pipeline 把src/channels中counter、squarer、printer那样用channel连接的阶段做成通用的库。
+// 每个阶段有名字和类型，阶段之间用单向channel连接，可以指定并行的worker数(fan-out/fan-in)以及是否保持输入顺序:
+//
+//	p := pipeline.New(ctx)
+//	naturals := pipeline.Source(p, "counter", func(ctx context.Context, emit func(int) bool) error {
+//		for x := 0; x < 100 && emit(x); x++ {
+//		}
+//		return nil
+//	})
+//	squares := pipeline.Map(naturals, "squarer", func(ctx context.Context, x int) (int, error) {
+//		return x * x, nil
+//	}, pipeline.Workers(4), pipeline.Ordered())
+//	pipeline.ForEach(squares, "printer", func(ctx context.Context, x int) error {
+//		_, err := fmt.Println(x)
+//		return err
+//	})
+//	if err := p.Wait(); err != nil {
+//		log.Fatal(err) // 比如 pipeline: stage squarer: ...
+//	}
+//
+// 任何一个阶段返回错误时取消整个pipeline的Context，所有阶段停止发送并关闭各自的输出，Wait返回第一个错误。
+// 直接读取Out()的调用者如果提前不读了，要调用Stop，否则上游的goroutine会一直阻塞在发送上。
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Skip 由Map的函数返回时丢弃这个元素，不算错误
+var Skip = errors.New("pipeline: skip item")
+
+// StageError 是某个阶段返回的错误
+type StageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return "pipeline: stage " + e.Stage + ": " + e.Err.Error()
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// Pipeline 管理所有阶段的goroutine、取消和错误
+type Pipeline struct {
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	once sync.Once
+	err  error
+}
+
+// New 返回一个空的pipeline，ctx取消时所有阶段停止
+func New(ctx context.Context) *Pipeline {
+	p := &Pipeline{parent: ctx}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	return p
+}
+
+// Context 在pipeline出错、Stop或者父Context取消时被取消，阶段的函数应当用它来放弃耗时的操作
+func (p *Pipeline) Context() context.Context {
+	return p.ctx
+}
+
+// Stop 让所有阶段尽快停止，不算错误
+func (p *Pipeline) Stop() {
+	p.cancel()
+}
+
+// Wait 等待所有阶段的goroutine退出，返回第一个阶段错误；没有阶段出错但父Context被取消时返回父Context的错误
+func (p *Pipeline) Wait() error {
+	p.wg.Wait()
+	p.cancel()
+	if p.err != nil {
+		return p.err
+	}
+	return p.parent.Err()
+}
+
+// fail 记录阶段错误并取消pipeline。取消以后的错误大多是取消引起的，不再记录
+func (p *Pipeline) fail(stage string, err error) {
+	if p.ctx.Err() != nil {
+		return
+	}
+	p.once.Do(func() { p.err = &StageError{Stage: stage, Err: err} })
+	p.cancel()
+}
+
+// goFunc 启动一个属于pipeline的goroutine，Wait会等待它退出
+func (p *Pipeline) goFunc(f func()) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		f()
+	}()
+}
+
+// Stream 是一个阶段的输出
+type Stream[T any] struct {
+	p  *Pipeline
+	ch <-chan T
+}
+
+// Out 返回输出channel，pipeline结束(包括出错和取消)时关闭
+func (s *Stream[T]) Out() <-chan T {
+	return s.ch
+}
+
+type options struct {
+	workers int
+	buffer  int
+	ordered bool
+}
+
+type Option func(*options)
+
+// Workers 设置同时处理的goroutine个数，默认1
+func Workers(n int) Option {
+	return func(o *options) {
+		if n > 0 {
+			o.workers = n
+		}
+	}
+}
+
+// Buffer 设置阶段输出channel的缓冲区大小，默认0
+func Buffer(n int) Option {
+	return func(o *options) {
+		if n >= 0 {
+			o.buffer = n
+		}
+	}
+}
+
+// Ordered 让多个worker的输出保持输入的顺序。
+// 一个慢的元素会挡住后面已经处理完的元素，同时处理中的元素最多是worker数的两倍
+func Ordered() Option {
+	return func(o *options) { o.ordered = true }
+}
+
+func newOptions(opts []Option) options {
+	o := options{workers: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// send 发送v，pipeline取消时返回false
+func send[T any](ctx context.Context, out chan<- T, v T) bool {
+	select {
+	case out <- v:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Source 在一个goroutine中执行gen产生数据。emit返回false表示pipeline已经取消，gen应当返回
+func Source[T any](p *Pipeline, name string, gen func(ctx context.Context, emit func(T) bool) error, opts ...Option) *Stream[T] {
+	o := newOptions(opts)
+	out := make(chan T, o.buffer)
+	p.goFunc(func() {
+		defer close(out)
+		emit := func(v T) bool { return send(p.ctx, out, v) }
+		if err := gen(p.ctx, emit); err != nil {
+			p.fail(name, err)
+		}
+	})
+	return &Stream[T]{p: p, ch: out}
+}
+
+// FromSlice 依次产生items中的元素
+func FromSlice[T any](p *Pipeline, items []T, opts ...Option) *Stream[T] {
+	return Source(p, "slice", func(ctx context.Context, emit func(T) bool) error {
+		for _, v := range items {
+			if !emit(v) {
+				return nil
+			}
+		}
+		return nil
+	}, opts...)
+}
+
+// Map 用f处理s中的每个元素。f返回Skip时丢弃这个元素，返回其它错误时整个pipeline停止
+func Map[In, Out any](s *Stream[In], name string, f func(ctx context.Context, v In) (Out, error), opts ...Option) *Stream[Out] {
+	o := newOptions(opts)
+	out := make(chan Out, o.buffer)
+	if o.ordered && o.workers > 1 {
+		mapOrdered(s.p, name, s.ch, out, f, o.workers)
+	} else {
+		mapUnordered(s.p, name, s.ch, out, f, o.workers)
+	}
+	return &Stream[Out]{p: s.p, ch: out}
+}
+
+// ForEach 用f消费s中的每个元素，是pipeline的最后一个阶段，结果用Pipeline.Wait获取
+func ForEach[T any](s *Stream[T], name string, f func(ctx context.Context, v T) error, opts ...Option) {
+	// 所有元素都被Skip，输出channel上不会有数据，不需要读取
+	Map(s, name, func(ctx context.Context, v T) (struct{}, error) {
+		if err := f(ctx, v); err != nil {
+			return struct{}{}, err
+		}
+		return struct{}{}, Skip
+	}, opts...)
+}
+
+// Collect 读取s中的所有元素，等待pipeline结束后返回
+func Collect[T any](s *Stream[T]) ([]T, error) {
+	var items []T
+	for v := range s.ch {
+		items = append(items, v)
+	}
+	return items, s.p.Wait()
+}
+
+// mapUnordered 启动n个worker，共同读取in写入out，全部结束后关闭out
+func mapUnordered[In, Out any](p *Pipeline, name string, in <-chan In, out chan<- Out, f func(context.Context, In) (Out, error), n int) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		p.goFunc(func() {
+			defer wg.Done()
+			for {
+				var v In
+				var ok bool
+				select {
+				case v, ok = <-in:
+				case <-p.ctx.Done():
+					return
+				}
+				if !ok {
+					return
+				}
+				r, err := f(p.ctx, v)
+				if err == Skip {
+					continue
+				}
+				if err != nil {
+					p.fail(name, err)
+					return
+				}
+				if !send(p.ctx, out, r) {
+					return
+				}
+			}
+		})
+	}
+	p.goFunc(func() {
+		wg.Wait()
+		close(out)
+	})
+}
+
+type result[T any] struct {
+	v  T
+	ok bool // false表示被Skip
+}
+
+type job[In, Out any] struct {
+	v   In
+	res chan result[Out] // 缓冲区为1，worker写入时不会阻塞
+}
+
+// mapOrdered 给每个元素一个结果channel，按输入的顺序排进order，collector依次等待这些结果
+func mapOrdered[In, Out any](p *Pipeline, name string, in <-chan In, out chan<- Out, f func(context.Context, In) (Out, error), n int) {
+	jobs := make(chan job[In, Out])
+	order := make(chan chan result[Out], n)
+
+	p.goFunc(func() {
+		defer close(jobs)
+		defer close(order)
+		for {
+			var v In
+			var ok bool
+			select {
+			case v, ok = <-in:
+			case <-p.ctx.Done():
+				return
+			}
+			if !ok {
+				return
+			}
+			j := job[In, Out]{v: v, res: make(chan result[Out], 1)}
+			if !send(p.ctx, order, j.res) || !send(p.ctx, jobs, j) {
+				return
+			}
+		}
+	})
+
+	for i := 0; i < n; i++ {
+		p.goFunc(func() {
+			for j := range jobs {
+				r, err := f(p.ctx, j.v)
+				if err == Skip {
+					j.res <- result[Out]{}
+					continue
+				}
+				if err != nil {
+					p.fail(name, err)
+					return
+				}
+				j.res <- result[Out]{v: r, ok: true}
+			}
+		})
+	}
+
+	p.goFunc(func() {
+		defer close(out)
+		for res := range order {
+			select {
+			case r := <-res:
+				if r.ok && !send(p.ctx, out, r.v) {
+					return
+				}
+			case <-p.ctx.Done():
+				return
+			}
+		}
+	})
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"strings"
 	"time"
+
+	"go-practice/src/lifecycle"
 )
 
+var drain = flag.Duration("drain", 10*time.Second, "time to wait for in-flight requests on shutdown")
+
 func sayHelloName(w http.ResponseWriter, r *http.Request) {
-	r.ParseForm() //解析参数，默认是不会解析的
+	r.ParseForm()       //解析参数，默认是不会解析的
 	fmt.Println(r.Form) //这些信息是输出到服务器端的打印信息
 	fmt.Println("path", r.URL.Path)
 	fmt.Println("scheme", r.URL.Scheme)
@@ -23,14 +28,17 @@ func sayHelloName(w http.ResponseWriter, r *http.Request) {
 }
 
 // go tool pprof -http=:1234 http://localhost:8005/debug/pprof/profile?seconds=20
-func main(){
+func main() {
+	flag.Parse()
+	lc := lifecycle.New(*drain)
 	go func() {
-		for {
+		for lc.Context().Err() == nil {
 			time.Sleep(10)
 		}
 	}()
 	http.HandleFunc("/", sayHelloName) //设置访问的路由
-	err := http.ListenAndServe("0.0.0.0:8005", nil)
+	lc.RegisterHealth(http.DefaultServeMux)
+	err := lc.ListenAndServe(&http.Server{Addr: "0.0.0.0:8005"})
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
@@ -0,0 +1,235 @@
+// Package progress 在命令行工具运行时显示进度。总数已知时显示进度条、百分比、速度和预计剩余时间，
+// 总数未知时显示转圈的spinner、已完成的个数和速度:
+//
+//	bar := progress.NewBar("scoring", int64(len(rows))).Start(ctx)
+//	defer bar.Stop()
+//	for ... {
+//		bar.Add(1) // 可以在多个goroutine中同时调用
+//	}
+//
+// 输出是终端时在同一行原地刷新；输出被重定向到文件或管道时每隔LogInterval打印一行，不会写满控制字符。
+// Stop或者ctx取消以后打印最后一行并换行，之后Add仍然可以调用但不再显示；再次Start时计数从0开始。
+package progress
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const barWidth = 30
+
+var frames = []string{"|", "/", "-", "\\"}
+
+// Bar 是一个进度显示，Total<=0时是spinner。字段只能在Start之前修改
+type Bar struct {
+	Label       string
+	Total       int64
+	Output      io.Writer     // 默认os.Stderr
+	Interval    time.Duration // 终端上的刷新间隔，默认100ms
+	LogInterval time.Duration // 不是终端时打印一行的间隔，默认10s
+
+	done  int64 // 原子操作
+	start time.Time
+	tty   bool
+	frame int
+
+	mu      sync.Mutex
+	stop    chan struct{} // 这一次显示的停止信号，没有在显示时为nil
+	stopped chan struct{}
+}
+
+// NewBar 返回一个总数为total的进度条，调用Start以后开始显示
+func NewBar(label string, total int64) *Bar {
+	return &Bar{
+		Label:       label,
+		Total:       total,
+		Output:      os.Stderr,
+		Interval:    100 * time.Millisecond,
+		LogInterval: 10 * time.Second,
+		start:       time.Now(),
+	}
+}
+
+// NewSpinner 返回一个不知道总数的进度显示
+func NewSpinner(label string) *Bar {
+	return NewBar(label, 0)
+}
+
+// IsTerminal 判断w是不是终端，不是*os.File时返回false
+func IsTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Start 开始显示，直到调用Stop或者ctx被取消。计数清零，速度和剩余时间从这时开始计算。
+// 上一次的显示还没有结束时先结束它
+func (b *Bar) Start(ctx context.Context) *Bar {
+	b.Stop()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tty = IsTerminal(b.Output)
+	b.start = time.Now()
+	b.frame = 0
+	atomic.StoreInt64(&b.done, 0)
+	b.stop = make(chan struct{})
+	b.stopped = make(chan struct{})
+	go b.run(ctx, b.stop, b.stopped)
+	return b
+}
+
+// Stop 停止显示并打印最后的结果，可以重复调用，没有在显示时什么也不做
+func (b *Bar) Stop() {
+	b.mu.Lock()
+	stop, stopped := b.stop, b.stopped
+	b.stop, b.stopped = nil, nil
+	b.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-stopped
+}
+
+// Add 增加已完成的个数，可以并发调用
+func (b *Bar) Add(n int64) {
+	atomic.AddInt64(&b.done, n)
+}
+
+// Set 设置已完成的个数，适合进度由别处算好的情况
+func (b *Bar) Set(n int64) {
+	atomic.StoreInt64(&b.done, n)
+}
+
+// Current 返回已完成的个数
+func (b *Bar) Current() int64 {
+	return atomic.LoadInt64(&b.done)
+}
+
+func (b *Bar) run(ctx context.Context, stop <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+	interval := b.Interval
+	if !b.tty {
+		interval = b.LogInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	if b.tty {
+		b.print(false)
+	}
+	for {
+		select {
+		case <-ticker.C:
+			b.print(false)
+		case <-stop:
+			b.print(true)
+			return
+		case <-ctx.Done():
+			b.print(true)
+			return
+		}
+	}
+}
+
+// print 输出一次进度，final为true时输出总结并换行
+func (b *Bar) print(final bool) {
+	elapsed := time.Since(b.start)
+	line := b.line(b.Current(), elapsed, final)
+	if b.tty {
+		// \r回到行首，\x1b[K清掉上一次留下的更长的内容
+		line = "\r" + line + "\x1b[K"
+		if final {
+			line += "\n"
+		}
+	} else {
+		line += "\n"
+	}
+	io.WriteString(b.Output, line)
+	b.frame++
+}
+
+func (b *Bar) line(done int64, elapsed time.Duration, final bool) string {
+	var s []string
+	if b.Label != "" {
+		s = append(s, b.Label)
+	}
+	rate := float64(0)
+	if elapsed > 0 {
+		rate = float64(done) / elapsed.Seconds()
+	}
+	// spinner没有调用过Add时只显示时间
+	counted := b.Total > 0 || done > 0
+	if final {
+		switch {
+		case b.Total > 0:
+			s = append(s, fmt.Sprintf("%d/%d", done, b.Total))
+		case done > 0:
+			s = append(s, fmt.Sprint(done))
+		default:
+			s = append(s, "done")
+		}
+		s = append(s, "in", round(elapsed).String())
+		if counted {
+			s = append(s, "("+formatRate(rate)+")")
+		}
+		return strings.Join(s, " ")
+	}
+	if b.Total <= 0 {
+		if b.tty {
+			s = append(s, frames[b.frame%len(frames)])
+		}
+		if counted {
+			s = append(s, fmt.Sprint(done), formatRate(rate))
+		}
+		return strings.Join(append(s, round(elapsed).String()), " ")
+	}
+	frac := float64(done) / float64(b.Total)
+	if frac > 1 {
+		frac = 1
+	}
+	if b.tty {
+		s = append(s, bar(frac))
+	}
+	s = append(s, fmt.Sprintf("%5.1f%%", frac*100), fmt.Sprintf("%d/%d", done, b.Total), formatRate(rate))
+	if rate > 0 && done < b.Total {
+		eta := time.Duration(float64(b.Total-done) / rate * float64(time.Second))
+		s = append(s, "ETA "+round(eta).String())
+	}
+	return strings.Join(s, " ")
+}
+
+// bar 画出 [=====>    ]
+func bar(frac float64) string {
+	n := int(frac * barWidth)
+	head := ""
+	if n < barWidth {
+		head = ">"
+	}
+	return "[" + strings.Repeat("=", n) + head + strings.Repeat(" ", barWidth-n-len(head)) + "]"
+}
+
+func formatRate(rate float64) string {
+	switch {
+	case rate >= 1e6:
+		return fmt.Sprintf("%.1fM/s", rate/1e6)
+	case rate >= 1e3:
+		return fmt.Sprintf("%.1fk/s", rate/1e3)
+	}
+	return fmt.Sprintf("%.1f/s", rate)
+}
+
+func round(d time.Duration) time.Duration {
+	if d < time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Second)
+}
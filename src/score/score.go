@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/dmitryikh/leaves"
+	"github.com/dmitryikh/leaves/mat"
+
+	"go-practice/src/progress"
+)
+
+// score 用和src/web预测服务相同的leaves推理路径离线批量打分:
+//
+//	go run score.go -model model.txt -input data.csv -output pred.csv
+//	go run score.go -model xg.model -format xgboost -input data.libsvm -input-format libsvm -output-format jsonl
+//
+// 输入按 -chunk 行一批读取，每批调用 PredictDense/PredictCSR 后立即写出，内存占用和输入文件大小无关。
+// 运行期间在stderr上显示已打分的行数和速度，-progress=false 关闭
+
+var (
+	modelPath    = flag.String("model", "", "model file")
+	modelFormat  = flag.String("format", "lightgbm", "model format: lightgbm, xgboost, xgblinear or sklearn")
+	inputPath    = flag.String("input", "-", "input file, - for stdin")
+	inputFormat  = flag.String("input-format", "csv", "input format: csv or libsvm")
+	delimiter    = flag.String("delimiter", ",", "csv delimiter")
+	skipFirst    = flag.Bool("skip-first-column", false, "skip the first column (label) of every input row")
+	defValue     = flag.Float64("missing", 0, "value used for empty csv fields")
+	outputPath   = flag.String("output", "-", "output file, - for stdout")
+	outputFormat = flag.String("output-format", "csv", "output format: csv or jsonl")
+	chunkRows    = flag.Int("chunk", 10000, "rows read and predicted per batch")
+	nThreads     = flag.Int("threads", 1, "number of threads used by leaves")
+	nEstimators  = flag.Int("n-estimators", 0, "use only the first n estimators, 0 for all")
+	raw          = flag.Bool("raw", false, "output raw predictions without the model transformation")
+	showProgress = flag.Bool("progress", true, "show scored rows and throughput on stderr")
+)
+
+var loaders = map[string]func(*bufio.Reader, bool) (*leaves.Ensemble, error){
+	"lightgbm":  leaves.LGEnsembleFromReader,
+	"xgboost":   leaves.XGEnsembleFromReader,
+	"xgblinear": leaves.XGBLinearFromReader,
+	"sklearn":   leaves.SKEnsembleFromReader,
+}
+
+func main() {
+	flag.Parse()
+	if *modelPath == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *chunkRows <= 0 {
+		log.Fatal("-chunk must be positive")
+	}
+	// 在加载模型和创建输出文件之前检查格式，不要等到写第一行时才失败
+	switch *inputFormat {
+	case "csv", "libsvm":
+	default:
+		log.Fatalf("unknown -input-format %q", *inputFormat)
+	}
+	switch *outputFormat {
+	case "csv", "jsonl":
+	default:
+		log.Fatalf("unknown -output-format %q", *outputFormat)
+	}
+	model, err := loadModel(*modelFormat, *modelPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *raw {
+		model = model.EnsembleWithRawPredictions()
+	}
+	log.Printf("loaded %s: %d features, %d estimators, %d output groups",
+		model.Name(), model.NFeatures(), model.NEstimators(), model.NOutputGroups())
+
+	in, err := openInput(*inputPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+	out, err := createOutput(*outputPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := bufio.NewWriter(out)
+
+	start := time.Now()
+	bar := progress.NewSpinner("scoring")
+	if *showProgress {
+		bar.Start(context.Background())
+	}
+	rows, err := score(model, bufio.NewReader(in), w, bar)
+	bar.Stop()
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.Fatalf("after %d rows: %v", rows, err)
+	}
+	log.Printf("scored %d rows in %v", rows, time.Since(start))
+}
+
+func loadModel(format, path string) (*leaves.Ensemble, error) {
+	load, ok := loaders[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown model format %q", format)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return load(bufio.NewReader(f), true)
+}
+
+// score 按批读取输入并写出预测结果，返回已处理的行数
+func score(model *leaves.Ensemble, r *bufio.Reader, w io.Writer, bar *progress.Bar) (int, error) {
+	nGroups := model.NOutputGroups()
+	predictions := make([]float64, *chunkRows*nGroups)
+	total := 0
+	for {
+		var n int
+		switch *inputFormat {
+		case "csv":
+			m, err := mat.DenseMatFromCsv(r, *chunkRows, *skipFirst, *delimiter, *defValue)
+			if err != nil {
+				return total, err
+			}
+			if n = m.Rows; n == 0 {
+				return total, nil
+			}
+			if m.Cols < model.NFeatures() {
+				return total, fmt.Errorf("input has %d columns, model expects %d features", m.Cols, model.NFeatures())
+			}
+			err = model.PredictDense(m.Values, m.Rows, m.Cols, predictions, *nEstimators, *nThreads)
+			if err != nil {
+				return total, err
+			}
+		case "libsvm":
+			m, err := mat.CSRMatFromLibsvm(r, *chunkRows, *skipFirst)
+			if err != nil {
+				return total, err
+			}
+			if n = m.Rows(); n == 0 {
+				return total, nil
+			}
+			err = model.PredictCSR(m.RowHeaders, m.ColIndexes, m.Values, predictions, *nEstimators, *nThreads)
+			if err != nil {
+				return total, err
+			}
+		default:
+			return total, fmt.Errorf("unknown input format %q", *inputFormat)
+		}
+		if err := writePredictions(w, total, predictions[:n*nGroups], nGroups); err != nil {
+			return total, err
+		}
+		total += n
+		bar.Add(int64(n))
+		if n < *chunkRows {
+			return total, nil
+		}
+	}
+}
+
+func writePredictions(w io.Writer, first int, predictions []float64, nGroups int) error {
+	var line []byte
+	for i := 0; i*nGroups < len(predictions); i++ {
+		row := predictions[i*nGroups : (i+1)*nGroups]
+		line = line[:0]
+		switch *outputFormat {
+		case "jsonl":
+			data, err := json.Marshal(struct {
+				Row        int       `json:"row"`
+				Prediction []float64 `json:"prediction"`
+			}{first + i, row})
+			if err != nil {
+				return err
+			}
+			line = append(line, data...)
+		case "csv":
+			for j, v := range row {
+				if j > 0 {
+					line = append(line, ',')
+				}
+				line = strconv.AppendFloat(line, v, 'g', -1, 64)
+			}
+		default:
+			return fmt.Errorf("unknown output format %q", *outputFormat)
+		}
+		line = append(line, '\n')
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(path)
+}
+
+func createOutput(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(path)
+}
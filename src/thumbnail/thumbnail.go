@@ -0,0 +1,168 @@
+// Package thumbnail 只用标准库生成JPEG、PNG和GIF图片的缩略图。
+// 缩略图等比例缩小到不超过size×size，比size小的图片保持原来的尺寸，输出格式和输入相同。
+// GIF只取第一帧。
+package thumbnail
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultSize 是缩略图默认的最大宽高
+const DefaultSize = 128
+
+// Quality 是输出JPEG的质量
+const Quality = 85
+
+// Decode 解码一张图片，返回图片和格式名(jpeg、png或gif)
+func Decode(r io.Reader) (image.Image, string, error) {
+	return image.Decode(r)
+}
+
+// Encode 把img按format编码写入w
+func Encode(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: Quality})
+	case "png":
+		return png.Encode(w, img)
+	case "gif":
+		return gif.Encode(w, img, nil)
+	}
+	return fmt.Errorf("thumbnail: unsupported format %q", format)
+}
+
+// Size 返回把w×h等比例缩小到不超过size×size以后的宽高
+func Size(w, h, size int) (int, int) {
+	if w <= size && h <= size {
+		return w, h
+	}
+	if w >= h {
+		h = h * size / w
+		w = size
+	} else {
+		w = w * size / h
+		h = size
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return w, h
+}
+
+// Scale 返回缩小后的图片。每个输出像素取它覆盖的源像素的平均值(box filter)，缩小时不会出现锯齿
+func Scale(src image.Image, size int) image.Image {
+	sb := src.Bounds()
+	sw, sh := sb.Dx(), sb.Dy()
+	dw, dh := Size(sw, sh, size)
+
+	// 先转成RGBA，image/draw对常见格式(包括JPEG解码出来的YCbCr)有快速路径，
+	// 之后直接读Pix。RGBA是预乘alpha的，透明像素求平均时不会带出颜色
+	rgba, ok := src.(*image.RGBA)
+	if !ok || sb.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, sw, sh))
+		draw.Draw(rgba, rgba.Bounds(), src, sb.Min, draw.Src)
+	}
+	if dw == sw && dh == sh {
+		return rgba
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0, sy1 := y*sh/dh, (y+1)*sh/dh
+		if sy1 == sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < dw; x++ {
+			sx0, sx1 := x*sw/dw, (x+1)*sw/dw
+			if sx1 == sx0 {
+				sx1 = sx0 + 1
+			}
+			var r, g, b, a, n int
+			for sy := sy0; sy < sy1; sy++ {
+				row := rgba.Pix[sy*rgba.Stride:]
+				for sx := sx0; sx < sx1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0], d[1], d[2], d[3] = uint8(r/n), uint8(g/n), uint8(b/n), uint8(a/n)
+		}
+	}
+	return dst
+}
+
+// Name 返回infile的缩略图文件名，和原图在同一个目录，比如 a/b.jpg -> a/b.thumb.jpg
+func Name(infile string) string {
+	ext := filepath.Ext(infile)
+	return strings.TrimSuffix(infile, ext) + ".thumb" + ext
+}
+
+// IsThumbnail 判断文件名是不是Name生成的
+func IsThumbnail(name string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(name, filepath.Ext(name)), ".thumb")
+}
+
+// File 读取infile并在同一个目录写入缩略图，返回缩略图的文件名和大小。
+// ctx在开始之前或者解码以后被取消时返回ctx.Err()，出错时不会留下写了一半的文件
+func File(ctx context.Context, infile string, size int) (string, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+	in, err := os.Open(infile)
+	if err != nil {
+		return "", 0, err
+	}
+	src, format, err := Decode(bufio.NewReader(in))
+	in.Close()
+	if err != nil {
+		return "", 0, fmt.Errorf("%s: %v", infile, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", 0, err
+	}
+
+	outfile := Name(infile)
+	out, err := os.Create(outfile)
+	if err != nil {
+		return "", 0, err
+	}
+	w := bufio.NewWriter(out)
+	err = Encode(w, Scale(src, size), format)
+	if err == nil {
+		err = w.Flush()
+	}
+	var n int64
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = out.Stat(); err == nil {
+			n = fi.Size()
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(outfile)
+		return "", 0, fmt.Errorf("%s: %v", outfile, err)
+	}
+	return outfile, n, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var cacheEvictions = expvar.NewInt("thumb_cache_evictions")
+
+// diskCache 把缩略图按内容地址保存在目录中，总大小超过max时删除最久没有用过的文件。
+// 文件名是 <key前两位>/<key>，key由原图的SHA-256和尺寸组成，所以原图内容不变时缓存一直有效。
+// 索引只在内存中，启动时按文件的修改时间重建，Get会更新修改时间，重启以后LRU的顺序不变
+type diskCache struct {
+	dir string
+	max int64
+
+	mu    sync.Mutex
+	lru   *list.List               // 前面是最近用过的，元素是*cacheEntry
+	items map[string]*list.Element // key -> lru中的元素
+	size  int64
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+func openCache(dir string, max int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &diskCache{dir: dir, max: max, lru: list.New(), items: make(map[string]*list.Element)}
+	type file struct {
+		key   string
+		size  int64
+		mtime time.Time
+	}
+	var files []file
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		if strings.HasSuffix(path, ".tmp") {
+			// 上次退出时没写完的文件
+			os.Remove(path)
+			return nil
+		}
+		// 忽略不是Put写入的文件
+		if name := fi.Name(); len(name) > 2 && filepath.Base(filepath.Dir(path)) == name[:2] {
+			files = append(files, file{name, fi.Size(), fi.ModTime()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.Before(files[j].mtime) })
+	for _, f := range files {
+		c.items[f.key] = c.lru.PushFront(&cacheEntry{key: f.key, size: f.size})
+		c.size += f.size
+	}
+	c.mu.Lock()
+	c.evict()
+	c.mu.Unlock()
+	log.Printf("cache %s: %d thumbnails, %d bytes", dir, c.lru.Len(), c.size)
+	expvar.Publish("thumb_cache_bytes", expvar.Func(func() interface{} { return c.Size() }))
+	return c, nil
+}
+
+func (c *diskCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// Size 返回缓存文件的总大小
+func (c *diskCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+// Get 读取缓存的缩略图
+func (c *diskCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	e, ok := c.items[key]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	p := c.path(key)
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		// 文件被别人删掉了，或者刚好被淘汰
+		c.remove(key, e)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return data, true
+}
+
+// Put 保存缩略图，比整个缓存还大的不保存
+func (c *diskCache) Put(key string, data []byte) error {
+	size := int64(len(data))
+	if size > c.max {
+		return nil
+	}
+	p := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// 先写临时文件再改名，读的一方不会看到写了一半的文件
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		entry := e.Value.(*cacheEntry)
+		c.size += size - entry.size
+		entry.size = size
+		c.lru.MoveToFront(e)
+	} else {
+		c.items[key] = c.lru.PushFront(&cacheEntry{key: key, size: size})
+		c.size += size
+	}
+	c.evict()
+	return nil
+}
+
+// remove 删除key的索引。只在索引还是e时删除，期间Put重新写入的文件不受影响
+func (c *diskCache) remove(key string, e *list.Element) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cur, ok := c.items[key]; ok && cur == e {
+		c.lru.Remove(e)
+		delete(c.items, key)
+		c.size -= e.Value.(*cacheEntry).size
+	}
+}
+
+// evict 删除最久没用过的文件直到总大小不超过max，调用时持有c.mu
+func (c *diskCache) evict() {
+	for c.size > c.max {
+		e := c.lru.Back()
+		entry := e.Value.(*cacheEntry)
+		if err := os.Remove(c.path(entry.key)); err != nil && !os.IsNotExist(err) {
+			log.Printf("cache: %v", err)
+		}
+		c.lru.Remove(e)
+		delete(c.items, entry.key)
+		c.size -= entry.size
+		cacheEvictions.Add(1)
+	}
+}
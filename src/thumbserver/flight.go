@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+var errPanicked = errors.New("thumbnail generation panicked")
+
+// call 是一次正在进行的生成，同一个key的其它请求等待它的结果
+type call struct {
+	wg   sync.WaitGroup
+	data []byte
+	err  error
+}
+
+// group 合并对同一个key的并发请求，fn只执行一次
+type group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// Do 执行fn并返回结果。已经有同一个key的fn在执行时等它完成并共享结果，这时shared为true
+func (g *group) Do(key string, fn func() ([]byte, error)) (data []byte, shared bool, err error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.data, true, c.err
+	}
+	c := new(call)
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	// fn panic时(net/http会恢复handler的panic)也要放行等待的请求
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.err = errPanicked
+	c.data, c.err = fn()
+	return c.data, false, c.err
+}
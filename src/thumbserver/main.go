@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-practice/src/lifecycle"
+	"go-practice/src/thumbnail"
+)
+
+// thumbserver 用src/thumbnail(也是src/channels/thumbnail.go使用的代码)通过HTTP生成缩略图:
+//
+//	curl -o t.jpg 'localhost:9100/thumbnail?path=shoes/a.jpg&size=200'            读取 -root 下的文件
+//	curl -o t.jpg --data-binary @a.jpg 'localhost:9100/thumbnail?size=200'        上传图片
+//	curl -o t.jpg -F image=@a.jpg 'localhost:9100/thumbnail?size=200'             multipart上传，字段名image
+//
+// size是最大宽高，默认128，最大 -max-size。返回的缩略图和原图格式相同。
+// 缩略图按原图内容的SHA-256和size保存在 -cache 目录中，总大小超过 -cache-size 时删除最久没用过的；
+// 同一张图同一个size的并发请求只生成一次。响应头 X-Cache 是 hit、miss 或者 coalesced(等了别的请求的结果)，
+// ETag是内容地址，带If-None-Match的请求返回304。计数器在 /debug/vars。
+
+var (
+	addr      = flag.String("addr", ":9100", "listen address")
+	root      = flag.String("root", "", "directory served by ?path=, empty to accept uploads only")
+	cacheDir  = flag.String("cache", "thumbcache", "thumbnail cache directory")
+	cacheSize = flag.Int64("cache-size", 256<<20, "maximum total size of cached thumbnails in bytes")
+	maxSize   = flag.Int("max-size", 1024, "largest thumbnail size a client may ask for")
+	maxUpload = flag.Int64("max-upload", 32<<20, "maximum image size in bytes")
+	maxPixels = flag.Int("max-pixels", 50e6, "maximum width*height of a source image")
+	workers   = flag.Int("workers", runtime.NumCPU(), "thumbnails generated at the same time")
+	drain     = flag.Duration("drain", 10*time.Second, "time to wait for in-flight requests on shutdown")
+)
+
+var (
+	requestHits      = expvar.NewInt("thumb_cache_hits")
+	requestMisses    = expvar.NewInt("thumb_cache_misses")
+	requestCoalesced = expvar.NewInt("thumb_coalesced_requests")
+)
+
+var errNotImage = httpError{http.StatusUnsupportedMediaType, "not a JPEG, PNG or GIF image"}
+
+func main() {
+	flag.Parse()
+	if *workers <= 0 || *maxSize <= 0 {
+		log.Fatal("-workers and -max-size must be positive")
+	}
+	cache, err := openCache(*cacheDir, *cacheSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &thumbService{cache: cache, workers: make(chan struct{}, *workers)}
+	http.Handle("/thumbnail", s)
+	lc := lifecycle.New(*drain)
+	lc.RegisterHealth(http.DefaultServeMux)
+	if err := lc.ListenAndServe(&http.Server{Addr: *addr}); err != nil {
+		log.Print("ListenAndServe: ", err)
+	}
+}
+
+type thumbService struct {
+	cache   *diskCache
+	calls   group
+	workers chan struct{} // 信号量，限制同时解码和缩放的图片数，也就限制了CPU和内存
+}
+
+func (s *thumbService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	size := thumbnail.DefaultSize
+	if v := r.URL.Query().Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > *maxSize {
+			http.Error(w, fmt.Sprintf("size must be between 1 and %d", *maxSize), http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+	var (
+		src []byte
+		err error
+	)
+	switch r.Method {
+	case "GET", "HEAD":
+		src, err = readPath(r.URL.Query().Get("path"))
+	case "POST":
+		src, err = readUpload(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sum := sha256.Sum256(src)
+	key := hex.EncodeToString(sum[:]) + "-" + strconv.Itoa(size)
+	etag := `"` + key + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	thumb, status, err := s.thumbnail(key, src, size)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(thumb))
+	w.Header().Set("Content-Length", strconv.Itoa(len(thumb)))
+	w.Header().Set("X-Cache", status)
+	if r.Method != "HEAD" {
+		w.Write(thumb)
+	}
+}
+
+// thumbnail 返回缓存中的缩略图，没有时生成，同一个key的并发请求合并成一次。
+// 生成和请求无关，发起的客户端断开也会完成并写入缓存，等待的其它请求仍然能拿到结果
+func (s *thumbService) thumbnail(key string, src []byte, size int) ([]byte, string, error) {
+	if data, ok := s.cache.Get(key); ok {
+		requestHits.Add(1)
+		return data, "hit", nil
+	}
+	data, shared, err := s.calls.Do(key, func() ([]byte, error) {
+		// 可能刚有一次生成结束，它的结果已经在缓存中了
+		if data, ok := s.cache.Get(key); ok {
+			return data, nil
+		}
+		s.workers <- struct{}{}
+		defer func() { <-s.workers }()
+		data, err := makeThumbnail(src, size)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.cache.Put(key, data); err != nil {
+			log.Printf("cache %s: %v", key, err)
+		}
+		return data, nil
+	})
+	if shared {
+		requestCoalesced.Add(1)
+		return data, "coalesced", err
+	}
+	requestMisses.Add(1)
+	return data, "miss", err
+}
+
+// makeThumbnail 先只读图片头检查尺寸，避免解码一张声称有几十亿像素的图片
+func makeThumbnail(src []byte, size int) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(src))
+	if err != nil {
+		return nil, errNotImage
+	}
+	if cfg.Width*cfg.Height > *maxPixels {
+		return nil, httpError{http.StatusRequestEntityTooLarge, fmt.Sprintf("image is %dx%d, at most %d pixels", cfg.Width, cfg.Height, *maxPixels)}
+	}
+	img, format, err := thumbnail.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, httpError{http.StatusBadRequest, err.Error()}
+	}
+	var buf bytes.Buffer
+	if err := thumbnail.Encode(&buf, thumbnail.Scale(img, size), format); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readPath 读取 -root 下的文件，path中的..不能离开 -root
+func readPath(p string) ([]byte, error) {
+	if *root == "" {
+		return nil, httpError{http.StatusForbidden, "reading server-side paths is disabled, upload the image with POST"}
+	}
+	if p == "" {
+		return nil, httpError{http.StatusBadRequest, "missing path"}
+	}
+	name := filepath.Join(*root, filepath.FromSlash(path.Clean("/"+p)))
+	f, err := os.Open(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, httpError{http.StatusNotFound, "no such image " + p}
+		}
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, httpError{http.StatusBadRequest, p + " is not a file"}
+	}
+	if fi.Size() > *maxUpload {
+		return nil, httpError{http.StatusRequestEntityTooLarge, fmt.Sprintf("image exceeds %d bytes", *maxUpload)}
+	}
+	return ioutil.ReadAll(f)
+}
+
+// readUpload 读取请求体中的图片，multipart/form-data时读取image字段
+func readUpload(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, *maxUpload)
+	var data []byte
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err = r.ParseMultipartForm(8 << 20); err == nil {
+			defer r.MultipartForm.RemoveAll()
+			file, _, ferr := r.FormFile("image")
+			if ferr != nil {
+				return nil, httpError{http.StatusBadRequest, "missing image field"}
+			}
+			defer file.Close()
+			data, err = ioutil.ReadAll(file)
+		}
+	} else {
+		data, err = ioutil.ReadAll(r.Body)
+	}
+	if err != nil {
+		if isTooLarge(err) {
+			return nil, httpError{http.StatusRequestEntityTooLarge, fmt.Sprintf("image exceeds %d bytes", *maxUpload)}
+		}
+		return nil, httpError{http.StatusBadRequest, err.Error()}
+	}
+	if len(data) == 0 {
+		return nil, httpError{http.StatusBadRequest, "empty request body"}
+	}
+	return data, nil
+}
+
+func isTooLarge(err error) bool {
+	return errors.As(err, new(*http.MaxBytesError))
+}
+
+// httpError 是带状态码的错误，其它错误按500返回
+type httpError struct {
+	code int
+	msg  string
+}
+
+func (e httpError) Error() string {
+	return e.msg
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if e, ok := err.(httpError); ok {
+		http.Error(w, e.msg, e.code)
+		return
+	}
+	log.Print(err)
+	http.Error(w, "internal error", http.StatusInternalServerError)
+}
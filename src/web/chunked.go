@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 分块上传接口，用于几百MB的大模型，中断后可以从服务端记录的offset继续上传:
+//   POST   /upload/chunked                 创建会话，body为JSON:
+//          {"token": ..., "name": ..., "format": ..., "filename": ..., "size": ..., "sha256": ..., "promote": true, "uploader": ..., "schema": {...}}
+//   GET    /upload/chunked/{id}            查询会话和已接收的字节数(offset)
+//   PUT    /upload/chunked/{id}            上传一块数据，Content-Range: bytes start-end/size，start必须等于offset，body的长度必须是end-start+1
+//   POST   /upload/chunked/{id}/complete   数据全部上传后校验SHA-256并保存到registry
+//   DELETE /upload/chunked/{id}            放弃上传
+// 会话信息和已上传的数据保存在磁盘上，进程重启后仍然可以继续
+
+const chunkSessionTTL = 24 * time.Hour
+
+var (
+	errSessionNotFound = errors.New("upload session not found")
+	validSessionID     = regexp.MustCompile(`^[0-9a-f]{32}$`)
+	contentRange       = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+)$`)
+)
+
+type chunkSession struct {
+	ID       string         `json:"id"`
+	Name     string         `json:"name"`
+	Format   string         `json:"format"`
+	Filename string         `json:"filename"`
+	Size     int64          `json:"size"`
+	SHA256   string         `json:"sha256"`
+	Promote  bool           `json:"promote"`
+	Uploader string         `json:"uploader,omitempty"`
+	Schema   *FeatureSchema `json:"schema,omitempty"`
+	Created  time.Time      `json:"created"`
+	Offset   int64          `json:"offset"` // 已接收的字节数，以磁盘上.part文件的大小为准
+}
+
+type chunkStore struct {
+	dir   string
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex // 同一个会话的写入串行进行
+}
+
+func newChunkStore(dir string) (*chunkStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &chunkStore{dir: dir, locks: make(map[string]*sync.Mutex)}, nil
+}
+
+func (s *chunkStore) create(sess *chunkSession) error {
+	s.expire()
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	sess.ID = hex.EncodeToString(b)
+	sess.Created = time.Now()
+	sess.Offset = 0
+	if err := ioutil.WriteFile(s.partPath(sess.ID), nil, 0644); err != nil {
+		return err
+	}
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.metaPath(sess.ID), data, 0644)
+}
+
+func (s *chunkStore) get(id string) (*chunkSession, error) {
+	if !validSessionID.MatchString(id) {
+		return nil, errSessionNotFound
+	}
+	data, err := ioutil.ReadFile(s.metaPath(id))
+	if os.IsNotExist(err) {
+		return nil, errSessionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	sess := &chunkSession{}
+	if err := json.Unmarshal(data, sess); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(s.partPath(id))
+	if err != nil {
+		return nil, err
+	}
+	sess.Offset = info.Size()
+	return sess, nil
+}
+
+// write 把从offset开始的一块数据追加到.part文件，返回新的offset。
+// 写入中途出错时已写入的部分保留，客户端从新的offset继续即可
+func (s *chunkStore) write(sess *chunkSession, offset int64, r io.Reader) (int64, error) {
+	if offset != sess.Offset {
+		return sess.Offset, fmt.Errorf("chunk starts at %d, expected %d", offset, sess.Offset)
+	}
+	f, err := os.OpenFile(s.partPath(sess.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return sess.Offset, err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return sess.Offset + n, err
+}
+
+func (s *chunkStore) remove(id string) {
+	os.Remove(s.partPath(id))
+	os.Remove(s.metaPath(id))
+	s.mu.Lock()
+	delete(s.locks, id)
+	s.mu.Unlock()
+}
+
+// expire 清理超过chunkSessionTTL没有收到数据的会话
+func (s *chunkStore) expire() {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		id := strings.TrimSuffix(info.Name(), ".part")
+		if id != info.Name() && time.Since(info.ModTime()) > chunkSessionTTL {
+			log.Printf("upload session %s expired", id)
+			s.remove(id)
+		}
+	}
+}
+
+// lock 锁住会话并返回拿到锁以后的会话信息。会话不存在时返回errSessionNotFound，
+// 这时不持有锁，locks中也不会留下这个id
+func (s *chunkStore) lock(id string) (*chunkSession, *sync.Mutex, error) {
+	if _, err := s.get(id); err != nil {
+		return nil, nil, err
+	}
+	s.mu.Lock()
+	l, ok := s.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		s.locks[id] = l
+	}
+	s.mu.Unlock()
+	l.Lock()
+	// 等锁的时候会话可能已经被删除了
+	sess, err := s.get(id)
+	if err != nil {
+		l.Unlock()
+		if err == errSessionNotFound {
+			s.mu.Lock()
+			if s.locks[id] == l {
+				delete(s.locks, id)
+			}
+			s.mu.Unlock()
+		}
+		return nil, nil, err
+	}
+	return sess, l, nil
+}
+
+func (s *chunkStore) partPath(id string) string { return filepath.Join(s.dir, id+".part") }
+func (s *chunkStore) metaPath(id string) string { return filepath.Join(s.dir, id+".json") }
+
+func chunkedUpload(store *chunkStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := splitPath(strings.TrimPrefix(r.URL.Path, "/upload/chunked"))
+		switch {
+		case len(parts) == 0 && r.Method == "POST":
+			createSession(store, w, r)
+		case len(parts) == 1 || len(parts) == 2 && parts[1] == "complete":
+			if !validSessionID.MatchString(parts[0]) {
+				http.Error(w, errSessionNotFound.Error(), http.StatusNotFound)
+				return
+			}
+			sess, l, err := store.lock(parts[0])
+			if err == errSessionNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer l.Unlock()
+			switch {
+			case len(parts) == 2 && r.Method == "POST":
+				completeSession(store, w, sess)
+			case len(parts) == 1 && r.Method == "GET":
+				writeJSON(w, http.StatusOK, sess)
+			case len(parts) == 1 && r.Method == "PUT":
+				writeChunk(store, w, r, sess)
+			case len(parts) == 1 && r.Method == "DELETE":
+				store.remove(sess.ID)
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}
+}
+
+func createSession(store *chunkStore, w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		chunkSession
+		Token string `json:"token"`
+	}
+	req.Promote = true
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !tokens.Consume(req.Token) {
+		http.Error(w, "invalid or expired upload token", http.StatusForbidden)
+		return
+	}
+	sess := req.chunkSession
+	sess.Filename = sanitizeFilename(sess.Filename)
+	if sess.Uploader == "" {
+		sess.Uploader = uploaderOf(r)
+	}
+	if sess.Name == "" {
+		sess.Name = strings.TrimSuffix(sess.Filename, filepath.Ext(sess.Filename))
+	}
+	switch {
+	case !validName.MatchString(sess.Name):
+		writeError(w, ErrInvalidName)
+		return
+	case loaders[sess.Format] == nil:
+		writeError(w, ErrUnknownFormat)
+		return
+	case sess.SHA256 == "":
+		http.Error(w, "sha256 is required", http.StatusBadRequest)
+		return
+	case sess.Size <= 0:
+		http.Error(w, "size is required", http.StatusBadRequest)
+		return
+	case sess.Size > *maxUpload:
+		http.Error(w, fmt.Sprintf("upload exceeds %d bytes", *maxUpload), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err := store.create(&sess); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("upload session %s: model %s, %d bytes", sess.ID, sess.Name, sess.Size)
+	writeJSON(w, http.StatusCreated, sess)
+}
+
+func writeChunk(store *chunkStore, w http.ResponseWriter, r *http.Request, sess *chunkSession) {
+	offset, length := sess.Offset, sess.Size-sess.Offset
+	cr := r.Header.Get("Content-Range")
+	if cr != "" {
+		m := contentRange.FindStringSubmatch(cr)
+		if m == nil {
+			http.Error(w, "bad Content-Range: "+cr, http.StatusBadRequest)
+			return
+		}
+		offset, _ = strconv.ParseInt(m[1], 10, 64)
+		end, _ := strconv.ParseInt(m[2], 10, 64)
+		total, _ := strconv.ParseInt(m[3], 10, 64)
+		if total != sess.Size || end < offset || end >= total {
+			http.Error(w, "bad Content-Range: "+cr, http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		length = end - offset + 1
+	}
+	if offset != sess.Offset {
+		// 客户端需要从返回的offset重新上传
+		writeJSON(w, http.StatusConflict, sess)
+		return
+	}
+	if r.ContentLength >= 0 && r.ContentLength != length && cr != "" {
+		http.Error(w, fmt.Sprintf("Content-Length %d does not match Content-Range length %d", r.ContentLength, length), http.StatusBadRequest)
+		return
+	}
+	// 最多读取Content-Range声明的长度，没有Content-Range时最多读到文件结束
+	r.Body = http.MaxBytesReader(w, r.Body, length)
+	n, err := store.write(sess, offset, r.Body)
+	sess.Offset = n
+	if isTooLarge(err) {
+		http.Error(w, fmt.Sprintf("chunk exceeds %d bytes, resume at offset %d", length, n), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		log.Printf("upload session %s: %v", sess.ID, err)
+		writeJSON(w, http.StatusBadRequest, sess)
+		return
+	}
+	if cr != "" && n-offset != length {
+		http.Error(w, fmt.Sprintf("chunk has %d bytes, Content-Range declares %d, resume at offset %d", n-offset, length, n), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, sess)
+}
+
+func completeSession(store *chunkStore, w http.ResponseWriter, sess *chunkSession) {
+	if sess.Offset != sess.Size {
+		http.Error(w, fmt.Sprintf("upload incomplete: %d of %d bytes", sess.Offset, sess.Size), http.StatusConflict)
+		return
+	}
+	f, err := os.Open(store.partPath(sess.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mv, err := registry.Save(ModelVersion{
+		Name:     sess.Name,
+		Format:   sess.Format,
+		Filename: sess.Filename,
+		SHA256:   sess.SHA256,
+		Uploader: sess.Uploader,
+	}, sess.Schema, f)
+	f.Close()
+	if err != nil {
+		// 校验和不一致或者模型无法加载时数据已经不可用，直接丢弃会话
+		if _, ok := err.(*ValidationError); ok || err == ErrChecksum {
+			store.remove(sess.ID)
+		}
+		writeError(w, err)
+		return
+	}
+	store.remove(sess.ID)
+	publish(w, mv, sess.Promote)
+}
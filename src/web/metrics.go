@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+)
+
+// 每次预测请求生成一个InfluxDB line protocol的point:
+//	prediction,model=iris,version=3,status=ok latency_ms=1.2,batch_size=20i,mean_score=0.37 1555312345000000000
+// point先放进channel，由后台goroutine按数量或时间间隔攒批写到文件或InfluxDB v2的 /api/v2/write。
+// channel满了直接丢弃并计数，写metrics不能拖慢预测
+
+const measurement = "prediction"
+
+// pointSink 接收一批换行分隔的line protocol
+type pointSink interface {
+	Write(lines []byte) error
+}
+
+// fileSink 把point追加到本地文件
+type fileSink struct {
+	path string
+}
+
+func (s *fileSink) Write(lines []byte) error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(lines)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// influxSink 把point写到InfluxDB v2的 /api/v2/write 接口
+type influxSink struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newInfluxSink(base, org, bucket, token string) *influxSink {
+	q := url.Values{}
+	q.Set("org", org)
+	q.Set("bucket", bucket)
+	q.Set("precision", "ns")
+	return &influxSink{
+		url:    base + "/api/v2/write?" + q.Encode(),
+		token:  token,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *influxSink) Write(lines []byte) error {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(lines))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Token "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influx write: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+type metrics struct {
+	sink      pointSink
+	points    chan models.Point
+	batchSize int
+	interval  time.Duration
+	dropped   int64
+	done      chan struct{}
+	mu        sync.RWMutex // Close之后Record不能再往已关闭的channel发送
+	closed    bool
+}
+
+func newMetrics(sink pointSink, batchSize int, interval time.Duration) *metrics {
+	m := &metrics{
+		sink:      sink,
+		points:    make(chan models.Point, batchSize*4),
+		batchSize: batchSize,
+		interval:  interval,
+		done:      make(chan struct{}),
+	}
+	go m.loop()
+	return m
+}
+
+// Record 记录一次预测。m为nil时(没有配置metrics输出)什么都不做
+func (m *metrics) Record(model string, version int, status string, latency time.Duration, batchSize int, meanScore float64) {
+	if m == nil {
+		return
+	}
+	v := "none"
+	if version > 0 {
+		v = strconv.Itoa(version)
+	}
+	tags := models.NewTags(map[string]string{"model": model, "version": v, "status": status})
+	fields := models.Fields{
+		"latency_ms": float64(latency) / float64(time.Millisecond),
+		"batch_size": int64(batchSize),
+	}
+	// NaN和Inf不能写入InfluxDB
+	if !math.IsNaN(meanScore) && !math.IsInf(meanScore, 0) {
+		fields["mean_score"] = meanScore
+	}
+	p, err := models.NewPoint(measurement, tags, fields, time.Now())
+	if err != nil {
+		log.Printf("metrics: %v", err)
+		return
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return
+	}
+	select {
+	case m.points <- p:
+	default:
+		atomic.AddInt64(&m.dropped, 1)
+	}
+}
+
+// Close 写出剩余的point后返回
+func (m *metrics) Close() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.points)
+	}
+	m.mu.Unlock()
+	<-m.done
+}
+
+func (m *metrics) loop() {
+	defer close(m.done)
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	var buf []byte
+	n := 0
+	flush := func() {
+		if n == 0 {
+			return
+		}
+		if err := m.sink.Write(buf); err != nil {
+			log.Printf("metrics: dropped %d points: %v", n, err)
+			atomic.AddInt64(&m.dropped, int64(n))
+		}
+		buf, n = buf[:0], 0
+		if d := atomic.SwapInt64(&m.dropped, 0); d > 0 {
+			log.Printf("metrics: %d points dropped since last flush", d)
+		}
+	}
+	for {
+		select {
+		case p, ok := <-m.points:
+			if !ok {
+				flush()
+				return
+			}
+			buf = append(p.AppendString(buf), '\n')
+			if n++; n >= m.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// meanScore 返回所有预测值的平均值
+func meanScore(predictions [][]float64) float64 {
+	var sum float64
+	n := 0
+	for _, row := range predictions {
+		for _, v := range row {
+			sum += v
+			n++
+		}
+	}
+	if n == 0 {
+		return math.NaN()
+	}
+	return sum / float64(n)
+}
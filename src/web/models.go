@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 模型管理接口:
+//   GET    /models                               列出所有模型
+//   GET    /models/{name}                        列出模型的所有版本
+//   GET    /models/{name}/{version}              版本元信息
+//   GET    /models/{name}/{version}/metadata     版本元信息，以及模型的特征数、树的数量、输出维度等
+//   GET    /models/{name}/{version}/file         下载模型文件
+//   POST   /models/{name}/{version}/promote      设为当前版本
+//   DELETE /models/{name}/{version}              删除版本
+// version 可以是数字，也可以是 current 或 latest
+
+type modelSummary struct {
+	Name     string `json:"name"`
+	Current  int    `json:"current,omitempty"`
+	Versions int    `json:"versions"`
+}
+
+type modelDetail struct {
+	Name     string          `json:"name"`
+	Current  int             `json:"current,omitempty"`
+	Versions []*ModelVersion `json:"versions"`
+}
+
+func modelsHandler(reg *Registry, srv *modelServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := splitPath(strings.TrimPrefix(r.URL.Path, "/models"))
+		switch {
+		case len(parts) == 0 && r.Method == "GET":
+			listModels(reg, w)
+		case len(parts) == 1 && r.Method == "GET":
+			listVersions(reg, w, parts[0])
+		case len(parts) == 2 || len(parts) == 3:
+			version, err := reg.Resolve(parts[0], parts[1])
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			action := ""
+			if len(parts) == 3 {
+				action = parts[2]
+			}
+			versionAction(reg, srv, w, r, parts[0], version, action)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}
+}
+
+func listModels(reg *Registry, w http.ResponseWriter) {
+	names, err := reg.Models()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	models := make([]modelSummary, 0, len(names))
+	for _, name := range names {
+		versions, err := reg.Versions(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		cur, _ := reg.Current(name)
+		models = append(models, modelSummary{Name: name, Current: cur, Versions: len(versions)})
+	}
+	writeJSON(w, http.StatusOK, models)
+}
+
+func listVersions(reg *Registry, w http.ResponseWriter, name string) {
+	versions, err := reg.Versions(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	cur, _ := reg.Current(name)
+	writeJSON(w, http.StatusOK, modelDetail{Name: name, Current: cur, Versions: versions})
+}
+
+func versionAction(reg *Registry, srv *modelServer, w http.ResponseWriter, r *http.Request, name string, version int, action string) {
+	switch {
+	case action == "" && r.Method == "GET":
+		mv, err := reg.Get(name, version)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, mv)
+	case action == "metadata" && r.Method == "GET":
+		mv, err := reg.Metadata(name, version)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, mv)
+	case action == "file" && r.Method == "GET":
+		mv, err := reg.Get(name, version)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(mv.Filename))
+		http.ServeFile(w, r, reg.Path(name, version))
+	case action == "promote" && r.Method == "POST":
+		if err := reg.Promote(name, version); err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Printf("model %s: promoted version %d", name, version)
+		if err := srv.Swap(name, version); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, modelSummary{Name: name, Current: version})
+	case action == "" && r.Method == "DELETE":
+		if err := reg.Delete(name, version); err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Printf("model %s: deleted version %d", name, version)
+		srv.Evict(name, version)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func splitPath(path string) []string {
+	var parts []string
+	for _, p := range strings.Split(path, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
+
+// writeError 把registry的错误映射成对应的HTTP状态码
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case ErrModelNotFound, ErrVersionNotFound:
+		status = http.StatusNotFound
+	case ErrInvalidName, ErrUnknownFormat:
+		status = http.StatusBadRequest
+	case ErrChecksum:
+		status = http.StatusUnprocessableEntity
+	case ErrVersionInUse:
+		status = http.StatusConflict
+	}
+	switch err.(type) {
+	case *ValidationError:
+		status = http.StatusUnprocessableEntity
+	case *SchemaError:
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dmitryikh/leaves"
+	"github.com/dmitryikh/leaves/mat"
+)
+
+// 预测接口: POST /predict/{model}/{version}，不指定version时按 /routes 中的规则选择版本(见routing.go)，
+// 没有路由规则时使用 current
+//
+// 请求体支持三种格式:
+//   application/json, 稠密矩阵:  {"rows": [[f0, f1, ...], ...]}
+//   application/json, 按特征名:  {"instances": [{"name": value, ...}, ...]}，要求模型上传时带有特征schema(见schema.go)
+//   application/json, CSR矩阵:   {"indptr": [...], "cols": [...], "vals": [...]}
+//   text/plain, libsvm文本:      每行 "label idx:val idx:val ..."，skip_label=false 时第一列也作为特征
+//
+// 查询参数:
+//   threads       预测使用的线程数，缺省为 -threads
+//   n_estimators  只使用前n棵树，0表示全部
+//   raw=true      返回未经过transformation的原始输出
+
+var (
+	errEmptyInput = errors.New("no rows in request")
+	errNoSchema   = errors.New("model has no feature schema, use positional rows")
+)
+
+type predictRequest struct {
+	Rows      [][]float64              `json:"rows"`
+	Instances []map[string]interface{} `json:"instances"`
+	Indptr    []int                    `json:"indptr"`
+	Cols      []int                    `json:"cols"`
+	Vals      []float64                `json:"vals"`
+}
+
+type predictResponse struct {
+	Model        string      `json:"model"`
+	Version      int         `json:"version"`
+	Raw          bool        `json:"raw"`
+	OutputGroups int         `json:"output_groups"`
+	Predictions  [][]float64 `json:"predictions"`
+}
+
+func predictHandler(srv *modelServer, router *router, stats *metrics, defaultThreads int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := splitPath(strings.TrimPrefix(r.URL.Path, "/predict"))
+		if len(parts) != 1 && len(parts) != 2 {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		// 每个请求结束时记录一个metrics point，status 随处理进度更新
+		start := time.Now()
+		status, served, batch, score := "bad_request", 0, 0, math.NaN()
+		defer func() {
+			stats.Record(parts[0], served, status, time.Since(start), batch, score)
+		}()
+
+		q := r.URL.Query()
+		threads, err := intParam(q.Get("threads"), defaultThreads)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "threads: " + err.Error()})
+			return
+		}
+		nEstimators, err := intParam(q.Get("n_estimators"), 0)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "n_estimators: " + err.Error()})
+			return
+		}
+		raw := q.Get("raw") == "true"
+		input, err := parseInput(r)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		batch = input.nRows()
+
+		// 没有显式指定版本时由路由规则决定主版本以及是否镜像到shadow版本
+		name, version := parts[0], ""
+		var shadow int
+		if len(parts) == 2 {
+			version = parts[1]
+		} else {
+			version, shadow = router.Pick(name, r)
+		}
+		// 持有引用直到请求结束，期间模型被切换也不会影响本次请求
+		loaded, err := srv.Acquire(name, version)
+		if err != nil {
+			status = "error"
+			if err == ErrModelNotFound || err == ErrVersionNotFound || err == ErrInvalidName {
+				status = "not_found"
+			}
+			writeError(w, err)
+			return
+		}
+		defer loaded.Release()
+		served = loaded.Version
+		model := loaded.Model
+		if raw {
+			model = model.EnsembleWithRawPredictions()
+		}
+
+		predictions, err := input.predict(model, loaded.Schema, nEstimators, threads)
+		if fe, ok := err.(*FeatureError); ok {
+			writeJSON(w, http.StatusBadRequest, fe)
+			return
+		} else if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		status, score = "ok", meanScore(predictions)
+		w.Header().Set("X-Model-Version", strconv.Itoa(loaded.Version))
+		writeJSON(w, http.StatusOK, predictResponse{
+			Model:        loaded.Name,
+			Version:      loaded.Version,
+			Raw:          raw,
+			OutputGroups: model.NOutputGroups(),
+			Predictions:  predictions,
+		})
+		if shadow > 0 && shadow != loaded.Version {
+			router.Shadow(shadowRequest{
+				name:        name,
+				primary:     loaded.Version,
+				shadow:      shadow,
+				key:         router.Key(name, r),
+				raw:         raw,
+				nEstimators: nEstimators,
+				threads:     threads,
+				input:       input,
+				predictions: predictions,
+			})
+		}
+	}
+}
+
+// predictInput 是解析后的请求数据，同一份数据可以依次在多个模型版本上预测
+type predictInput struct {
+	rows      [][]float64              // 稠密输入
+	instances []map[string]interface{} // 按特征名给出的输入，预测时按schema转换成稠密矩阵
+	indptr    []int                    // CSR输入
+	cols      []int
+	vals      []float64
+}
+
+// parseInput 根据Content-Type解析请求体
+func parseInput(r *http.Request) (*predictInput, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/plain") {
+		skipLabel := r.URL.Query().Get("skip_label") != "false"
+		csr, err := mat.CSRMatFromLibsvm(bufio.NewReader(r.Body), 0, skipLabel)
+		if err != nil {
+			return nil, err
+		}
+		return &predictInput{indptr: csr.RowHeaders, cols: csr.ColIndexes, vals: csr.Values}, nil
+	}
+	var req predictRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, fmt.Errorf("bad json: %v", err)
+	}
+	if req.Indptr != nil {
+		return &predictInput{indptr: req.Indptr, cols: req.Cols, vals: req.Vals}, nil
+	}
+	if req.Instances != nil {
+		return &predictInput{instances: req.Instances}, nil
+	}
+	return &predictInput{rows: req.Rows}, nil
+}
+
+func (in *predictInput) nRows() int {
+	if in.indptr != nil {
+		return len(in.indptr) - 1
+	}
+	if in.instances != nil {
+		return len(in.instances)
+	}
+	return len(in.rows)
+}
+
+// predict 调用PredictDense或PredictCSR，并把结果按行切分，每行 NOutputGroups 个值。
+// schema 不为nil时先按schema校验输入
+func (in *predictInput) predict(model *leaves.Ensemble, schema *FeatureSchema, nEstimators, threads int) ([][]float64, error) {
+	var (
+		flat []float64
+		err  error
+	)
+	switch {
+	case in.indptr != nil:
+		flat, err = predictCSR(model, schema, in.indptr, in.cols, in.vals, nEstimators, threads)
+	case in.instances != nil:
+		if schema == nil {
+			return nil, errNoSchema
+		}
+		var rows [][]float64
+		if rows, err = schema.Rows(in.instances); err != nil {
+			return nil, err
+		}
+		flat, err = predictDense(model, nil, rows, nEstimators, threads)
+	default:
+		flat, err = predictDense(model, schema, in.rows, nEstimators, threads)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return splitRows(flat, in.nRows(), model.NOutputGroups()), nil
+}
+
+func predictDense(model *leaves.Ensemble, schema *FeatureSchema, rows [][]float64, nEstimators, threads int) ([]float64, error) {
+	if len(rows) == 0 {
+		return nil, errEmptyInput
+	}
+	if schema != nil {
+		if err := schema.CheckRows(rows); err != nil {
+			return nil, err
+		}
+	}
+	ncols := len(rows[0])
+	vals := make([]float64, 0, len(rows)*ncols)
+	for i, row := range rows {
+		if len(row) != ncols {
+			return nil, fmt.Errorf("row %d has %d columns, expected %d", i, len(row), ncols)
+		}
+		vals = append(vals, row...)
+	}
+	if ncols < model.NFeatures() {
+		return nil, fmt.Errorf("rows have %d columns, model expects %d features", ncols, model.NFeatures())
+	}
+	predictions := make([]float64, len(rows)*model.NOutputGroups())
+	if err := model.PredictDense(vals, len(rows), ncols, predictions, nEstimators, threads); err != nil {
+		return nil, err
+	}
+	return predictions, nil
+}
+
+func predictCSR(model *leaves.Ensemble, schema *FeatureSchema, indptr, cols []int, vals []float64, nEstimators, threads int) ([]float64, error) {
+	nRows := len(indptr) - 1
+	if nRows <= 0 {
+		return nil, errEmptyInput
+	}
+	if len(cols) != len(vals) {
+		return nil, fmt.Errorf("cols and vals length mismatch: %d != %d", len(cols), len(vals))
+	}
+	for i := 0; i < nRows; i++ {
+		if indptr[i] < 0 || indptr[i] > indptr[i+1] || indptr[i+1] > len(vals) {
+			return nil, fmt.Errorf("invalid indptr at row %d", i)
+		}
+	}
+	for i, c := range cols {
+		if c < 0 {
+			return nil, fmt.Errorf("negative column index at position %d", i)
+		}
+	}
+	if schema != nil {
+		if err := schema.CheckCSR(indptr, cols, vals); err != nil {
+			return nil, err
+		}
+	}
+	predictions := make([]float64, nRows*model.NOutputGroups())
+	if err := model.PredictCSR(indptr, cols, vals, predictions, nEstimators, threads); err != nil {
+		return nil, err
+	}
+	return predictions, nil
+}
+
+func splitRows(flat []float64, nRows, nGroups int) [][]float64 {
+	rows := make([][]float64, nRows)
+	for i := range rows {
+		rows[i] = flat[i*nGroups : (i+1)*nGroups]
+	}
+	return rows
+}
+
+func intParam(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 {
+		return 0, fmt.Errorf("must not be negative")
+	}
+	return v, nil
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dmitryikh/leaves"
+)
+
+// 支持的模型格式，每种格式对应一个leaves的加载函数
+const (
+	FormatLightGBM  = "lightgbm"
+	FormatXGBoost   = "xgboost"
+	FormatXGBLinear = "xgblinear"
+	FormatSklearn   = "sklearn"
+)
+
+var loaders = map[string]func(*bufio.Reader, bool) (*leaves.Ensemble, error){
+	FormatLightGBM:  leaves.LGEnsembleFromReader,
+	FormatXGBoost:   leaves.XGEnsembleFromReader,
+	FormatXGBLinear: leaves.XGBLinearFromReader,
+	FormatSklearn:   leaves.SKEnsembleFromReader,
+}
+
+const (
+	modelFile   = "model.bin"
+	metaFile    = "meta.json"
+	schemaFile  = "schema.json"
+	currentFile = "CURRENT"
+)
+
+var (
+	ErrModelNotFound   = errors.New("model not found")
+	ErrVersionNotFound = errors.New("model version not found")
+	ErrVersionInUse    = errors.New("model version is current or used by a route, promote another version or change the route first")
+	ErrInvalidName     = errors.New("invalid model name")
+	ErrUnknownFormat   = errors.New("unknown model format")
+	ErrChecksum        = errors.New("sha256 checksum mismatch")
+)
+
+// ValidationError 表示上传的文件无法被对应格式的leaves加载函数解析
+type ValidationError struct {
+	Format string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s model: %v", e.Format, e.Err)
+}
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// ModelVersion 描述模型的一个版本，版本一旦写入就不会再被修改
+type ModelVersion struct {
+	Name     string     `json:"name"`
+	Version  int        `json:"version"`
+	Format   string     `json:"format"`
+	Filename string     `json:"filename"`
+	Size     int64      `json:"size"`
+	SHA256   string     `json:"sha256"`
+	Uploader string     `json:"uploader,omitempty"`
+	Created  time.Time  `json:"created"`
+	Model    *ModelInfo `json:"model,omitempty"`
+
+	Schema *FeatureSchema `json:"schema,omitempty"` // 单独保存在schema.json中，只在Metadata中返回
+}
+
+// ModelInfo 是从加载后的leaves.Ensemble中取出的信息，客户端据此构造特征向量
+type ModelInfo struct {
+	Estimator        string `json:"estimator"`
+	NFeatures        int    `json:"n_features"`
+	NEstimators      int    `json:"n_estimators"`
+	NRawOutputGroups int    `json:"n_raw_output_groups"`
+	NOutputGroups    int    `json:"n_output_groups"`
+	Transformation   string `json:"transformation"`
+}
+
+func newModelInfo(model *leaves.Ensemble) *ModelInfo {
+	return &ModelInfo{
+		Estimator:        model.Name(),
+		NFeatures:        model.NFeatures(),
+		NEstimators:      model.NEstimators(),
+		NRawOutputGroups: model.NRawOutputGroups(),
+		NOutputGroups:    model.NOutputGroups(),
+		Transformation:   model.Transformation().Name(),
+	}
+}
+
+// Registry 把模型按 root/<name>/<version>/ 的目录结构保存在磁盘上，
+// root/<name>/CURRENT 中记录当前对外服务的版本号
+type Registry struct {
+	root string
+	mu   sync.Mutex // 保护版本号分配、promote和删除
+}
+
+func NewRegistry(root string) (*Registry, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &Registry{root: root}, nil
+}
+
+// loadModel 用format对应的leaves加载函数解析模型。
+// leaves在解析损坏的二进制模型时可能直接panic，这里把panic转换成error
+func loadModel(format string, r io.Reader) (model *leaves.Ensemble, err error) {
+	load, ok := loaders[format]
+	if !ok {
+		return nil, ErrUnknownFormat
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			model, err = nil, fmt.Errorf("malformed model: %v", p)
+		}
+	}()
+	return load(bufio.NewReader(r), true)
+}
+
+func loadModelFile(format, path string) (*leaves.Ensemble, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return loadModel(format, f)
+}
+
+// Save 先把模型写到临时文件并用leaves加载校验，校验通过后才分配新的版本号。
+// info 中需要填写 Name、Format、Filename 和 Uploader，
+// info.SHA256 非空时必须和文件内容的SHA-256(十六进制)一致。
+// schema 可以为nil，不为nil时特征数必须和模型一致
+func (r *Registry) Save(info ModelVersion, schema *FeatureSchema, src io.Reader) (*ModelVersion, error) {
+	name, format := info.Name, info.Format
+	if !validName.MatchString(name) {
+		return nil, ErrInvalidName
+	}
+	if _, ok := loaders[format]; !ok {
+		return nil, ErrUnknownFormat
+	}
+	tmp, err := ioutil.TempFile(r.root, ".upload-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), src)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if info.SHA256 != "" && !strings.EqualFold(info.SHA256, sum) {
+		return nil, ErrChecksum
+	}
+	model, err := loadModelFile(format, tmp.Name())
+	if err != nil {
+		return nil, &ValidationError{Format: format, Err: err}
+	}
+	if schema != nil {
+		if err := schema.check(model.NFeatures()); err != nil {
+			return nil, err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := os.MkdirAll(filepath.Join(r.root, name), 0755); err != nil {
+		return nil, err
+	}
+	versions, err := r.versionNumbers(name)
+	if err != nil {
+		return nil, err
+	}
+	mv := &info
+	mv.Schema = nil
+	mv.Version = 1
+	mv.Size = size
+	mv.SHA256 = sum
+	mv.Created = time.Now()
+	mv.Model = newModelInfo(model)
+	if n := len(versions); n > 0 {
+		mv.Version = versions[n-1] + 1
+	}
+	vdir := r.versionDir(name, mv.Version)
+	if err := os.Mkdir(vdir, 0755); err != nil {
+		return nil, err
+	}
+	if err := writeJSONFile(filepath.Join(vdir, metaFile), mv); err != nil {
+		os.RemoveAll(vdir)
+		return nil, err
+	}
+	if schema != nil {
+		if err := writeJSONFile(filepath.Join(vdir, schemaFile), schema); err != nil {
+			os.RemoveAll(vdir)
+			return nil, err
+		}
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(vdir, modelFile)); err != nil {
+		os.RemoveAll(vdir)
+		return nil, err
+	}
+	os.Chmod(filepath.Join(vdir, modelFile), 0444)
+	// 第一个版本自动成为当前版本
+	if _, err := r.current(name); err == ErrVersionNotFound {
+		if err := r.setCurrent(name, mv.Version); err != nil {
+			return nil, err
+		}
+	}
+	return mv, nil
+}
+
+// Models 返回所有模型名
+func (r *Registry) Models() ([]string, error) {
+	infos, err := ioutil.ReadDir(r.root)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() && validName.MatchString(info.Name()) {
+			names = append(names, info.Name())
+		}
+	}
+	return names, nil
+}
+
+// Versions 按版本号升序返回模型的所有版本
+func (r *Registry) Versions(name string) ([]*ModelVersion, error) {
+	if !validName.MatchString(name) {
+		return nil, ErrInvalidName
+	}
+	nums, err := r.versionNumbers(name)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]*ModelVersion, 0, len(nums))
+	for _, v := range nums {
+		mv, err := r.Get(name, v)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, mv)
+	}
+	return versions, nil
+}
+
+func (r *Registry) Get(name string, version int) (*ModelVersion, error) {
+	if !validName.MatchString(name) {
+		return nil, ErrInvalidName
+	}
+	data, err := ioutil.ReadFile(filepath.Join(r.versionDir(name, version), metaFile))
+	if os.IsNotExist(err) {
+		return nil, ErrVersionNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	mv := &ModelVersion{}
+	if err := json.Unmarshal(data, mv); err != nil {
+		return nil, err
+	}
+	return mv, nil
+}
+
+// Resolve 把URL中的版本字符串解析成版本号，除了数字还支持current和latest
+func (r *Registry) Resolve(name, version string) (int, error) {
+	if !validName.MatchString(name) {
+		return 0, ErrInvalidName
+	}
+	switch version {
+	case "current", "":
+		return r.Current(name)
+	case "latest":
+		nums, err := r.versionNumbers(name)
+		if err != nil {
+			return 0, err
+		}
+		if len(nums) == 0 {
+			return 0, ErrVersionNotFound
+		}
+		return nums[len(nums)-1], nil
+	}
+	v, err := strconv.Atoi(version)
+	if err != nil || v <= 0 {
+		return 0, ErrVersionNotFound
+	}
+	return v, nil
+}
+
+func (r *Registry) Current(name string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current(name)
+}
+
+// Promote 把指定版本设为当前版本
+func (r *Registry) Promote(name string, version int) error {
+	if _, err := r.Get(name, version); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.setCurrent(name, version)
+}
+
+// Delete 删除一个版本，当前版本和路由规则(见routing.go)中用到的版本不允许删除
+func (r *Registry) Delete(name string, version int) error {
+	if _, err := r.Get(name, version); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cur, err := r.current(name); err == nil && cur == version {
+		return ErrVersionInUse
+	}
+	routed, err := r.routedVersions(name)
+	if err != nil {
+		return err
+	}
+	for _, v := range routed {
+		if v == version {
+			return ErrVersionInUse
+		}
+	}
+	return os.RemoveAll(r.versionDir(name, version))
+}
+
+// SetRoute 检查路由规则中用到的版本都存在并保存规则(见routing.go)。
+// 和Delete互斥，检查过的版本在规则保存之前不会被删除
+func (r *Registry) SetRoute(name string, route *Route) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, v := range route.versions() {
+		if _, err := r.Get(name, v); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(route, "", "    ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(r.root, name, routeFile)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// routedVersions 返回模型的路由规则中用到的版本，没有规则时返回nil。调用时持有r.mu
+func (r *Registry) routedVersions(name string) ([]int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(r.root, name, routeFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	route := &Route{}
+	if err := json.Unmarshal(data, route); err != nil {
+		return nil, err
+	}
+	return route.versions(), nil
+}
+
+// Metadata 返回版本元信息和特征schema，早期保存的版本没有记录模型信息时加载模型补上
+func (r *Registry) Metadata(name string, version int) (*ModelVersion, error) {
+	mv, err := r.Get(name, version)
+	if err != nil {
+		return nil, err
+	}
+	if mv.Model == nil {
+		model, err := loadModelFile(mv.Format, r.Path(name, version))
+		if err != nil {
+			return nil, err
+		}
+		mv.Model = newModelInfo(model)
+		// 旧版本的元数据没有模型信息，算出来以后写回去，之后不用再加载整个模型
+		if err := r.updateMeta(name, mv); err != nil {
+			return nil, err
+		}
+	}
+	if mv.Schema, err = r.Schema(name, version); err != nil {
+		return nil, err
+	}
+	return mv, nil
+}
+
+// updateMeta 替换版本的元数据文件，版本已经被删除时返回ErrVersionNotFound
+func (r *Registry) updateMeta(name string, mv *ModelVersion) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	path := filepath.Join(r.versionDir(name, mv.Version), metaFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrVersionNotFound
+	}
+	tmp := path + ".tmp"
+	os.Remove(tmp) // 元数据文件是只读的，上次没有rename成功的临时文件不能直接覆盖
+	if err := writeJSONFile(tmp, mv); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Schema 返回版本的特征schema，上传时没有提供schema时返回nil
+func (r *Registry) Schema(name string, version int) (*FeatureSchema, error) {
+	data, err := ioutil.ReadFile(filepath.Join(r.versionDir(name, version), schemaFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return parseSchema(data)
+}
+
+// Path 返回某个版本的模型文件路径
+func (r *Registry) Path(name string, version int) string {
+	return filepath.Join(r.versionDir(name, version), modelFile)
+}
+
+// Load 加载某个版本的模型
+func (r *Registry) Load(name string, version int) (*leaves.Ensemble, *ModelVersion, error) {
+	mv, err := r.Get(name, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	model, err := loadModelFile(mv.Format, r.Path(name, version))
+	if err != nil {
+		return nil, nil, err
+	}
+	return model, mv, nil
+}
+
+func (r *Registry) versionDir(name string, version int) string {
+	return filepath.Join(r.root, name, strconv.Itoa(version))
+}
+
+func (r *Registry) versionNumbers(name string) ([]int, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(r.root, name))
+	if os.IsNotExist(err) {
+		return nil, ErrModelNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var nums []int
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		if v, err := strconv.Atoi(info.Name()); err == nil {
+			nums = append(nums, v)
+		}
+	}
+	sort.Ints(nums)
+	return nums, nil
+}
+
+func (r *Registry) current(name string) (int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(r.root, name, currentFile))
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(r.root, name)); os.IsNotExist(err) {
+			return 0, ErrModelNotFound
+		}
+		return 0, ErrVersionNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// setCurrent 先写临时文件再rename，保证CURRENT文件的替换是原子的
+func (r *Registry) setCurrent(name string, version int) error {
+	path := filepath.Join(r.root, name, currentFile)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(version)+"\n"), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0444)
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 路由接口，只对不指定版本的 /predict/{model} 请求生效:
+//   GET    /routes/{model}         查看路由规则
+//   PUT    /routes/{model}         设置路由规则，例如
+//          {"split": [{"version": 3, "percent": 10}], "shadow": {"version": 4, "percent": 50}, "key_header": "X-User-Id"}
+//   DELETE /routes/{model}         删除路由规则，全部请求回到当前版本
+//   GET    /routes/{model}/stats   主版本和shadow版本预测结果的对比统计
+//
+// split 按请求key的hash把指定比例的请求分给对应版本，剩下的走primary(0表示current)。
+// shadow 把指定比例的请求在响应之后再异步地用候选版本预测一次，只记录差异，不影响响应。
+// 请求key取自 key_header 指定的请求头(默认X-Request-Key)或查询参数key，没有key时随机分配
+
+const (
+	routeFile        = "route.json"
+	shadowLogFile    = "shadow.jsonl"
+	shadowLogMax     = 64 << 20 // shadow.jsonl超过这个大小时改名为shadow.jsonl.1，只保留一个旧文件
+	defaultKeyHeader = "X-Request-Key"
+)
+
+// routeError 表示路由规则本身不合法
+type routeError string
+
+func (e routeError) Error() string { return "invalid route: " + string(e) }
+
+type Route struct {
+	Primary   int       `json:"primary,omitempty"`
+	Split     []Split   `json:"split,omitempty"`
+	Shadow    *Split    `json:"shadow,omitempty"`
+	KeyHeader string    `json:"key_header,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
+// versions 返回路由规则中用到的版本号，不包括表示current的0
+func (route *Route) versions() []int {
+	all := []int{route.Primary}
+	for _, s := range route.Split {
+		all = append(all, s.Version)
+	}
+	if route.Shadow != nil {
+		all = append(all, route.Shadow.Version)
+	}
+	var versions []int
+	for _, v := range all {
+		if v != 0 {
+			versions = append(versions, v)
+		}
+	}
+	return versions
+}
+
+type Split struct {
+	Version int     `json:"version"`
+	Percent float64 `json:"percent"`
+}
+
+// shadowStats 累计一对主版本/shadow版本之间的预测差异
+type shadowStats struct {
+	Primary      int     `json:"primary"`
+	Shadow       int     `json:"shadow"`
+	Requests     int64   `json:"requests"`
+	Rows         int64   `json:"rows"`
+	Errors       int64   `json:"errors"`
+	MeanAbsDelta float64 `json:"mean_abs_delta"`
+	MaxAbsDelta  float64 `json:"max_abs_delta"`
+	sumAbsDelta  float64
+	values       int64
+}
+
+type shadowRecord struct {
+	Time         time.Time `json:"time"`
+	Key          string    `json:"key,omitempty"`
+	Primary      int       `json:"primary"`
+	Shadow       int       `json:"shadow"`
+	Rows         int       `json:"rows"`
+	MeanAbsDelta float64   `json:"mean_abs_delta"`
+	MaxAbsDelta  float64   `json:"max_abs_delta"`
+	Error        string    `json:"error,omitempty"`
+}
+
+type shadowRequest struct {
+	name        string
+	primary     int
+	shadow      int
+	key         string
+	raw         bool
+	nEstimators int
+	threads     int
+	input       *predictInput
+	predictions [][]float64
+}
+
+type router struct {
+	reg     *Registry
+	srv     *modelServer
+	workers chan struct{} // 限制同时进行的shadow预测，满了就跳过，避免拖慢主流量
+	setMu   sync.Mutex    // 串行修改路由规则，文件和routes中的规则保持一致
+	logMu   sync.Mutex    // 串行写shadow日志，不占用mu，慢的磁盘不会拖慢Pick
+
+	mu      sync.RWMutex
+	routes  map[string]*Route
+	stats   map[string]*shadowStats // "name/primary/shadow" -> stats
+	skipped map[string]int64
+}
+
+func newRouter(reg *Registry, srv *modelServer, workers int) (*router, error) {
+	rt := &router{
+		reg:     reg,
+		srv:     srv,
+		workers: make(chan struct{}, workers),
+		routes:  make(map[string]*Route),
+		stats:   make(map[string]*shadowStats),
+		skipped: make(map[string]int64),
+	}
+	names, err := reg.Models()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(reg.root, name, routeFile))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		route := &Route{}
+		if err := json.Unmarshal(data, route); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		rt.routes[name] = route
+	}
+	return rt, nil
+}
+
+// Pick 返回本次请求应该使用的主版本(空串表示current)和shadow版本(0表示不镜像)
+func (rt *router) Pick(name string, r *http.Request) (string, int) {
+	rt.mu.RLock()
+	route := rt.routes[name]
+	rt.mu.RUnlock()
+	if route == nil {
+		return "", 0
+	}
+	key := rt.Key(name, r)
+	version := ""
+	if route.Primary > 0 {
+		version = strconv.Itoa(route.Primary)
+	}
+	b, acc := bucket(name, "split", key), 0.0
+	for _, s := range route.Split {
+		acc += s.Percent
+		if b < acc {
+			version = strconv.Itoa(s.Version)
+			break
+		}
+	}
+	shadow := 0
+	if route.Shadow != nil && bucket(name, "shadow", key) < route.Shadow.Percent {
+		shadow = route.Shadow.Version
+	}
+	return version, shadow
+}
+
+// Key 返回请求的路由key
+func (rt *router) Key(name string, r *http.Request) string {
+	header := defaultKeyHeader
+	rt.mu.RLock()
+	if route := rt.routes[name]; route != nil && route.KeyHeader != "" {
+		header = route.KeyHeader
+	}
+	rt.mu.RUnlock()
+	if key := r.Header.Get(header); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("key")
+}
+
+// bucket 把key映射到[0, 100)，相同的key总是落在同一个位置，split和shadow使用不同的salt互不影响
+func bucket(name, salt, key string) float64 {
+	if key == "" {
+		return rand.Float64() * 100
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name + "/" + salt + "/" + key))
+	return float64(h.Sum32()%10000) / 100
+}
+
+// Shadow 异步地用shadow版本重新预测并记录差异，shadow worker都在忙时直接跳过
+func (rt *router) Shadow(req shadowRequest) {
+	select {
+	case rt.workers <- struct{}{}:
+	default:
+		rt.mu.Lock()
+		rt.skipped[req.name]++
+		rt.mu.Unlock()
+		return
+	}
+	go func() {
+		defer func() { <-rt.workers }()
+		rt.record(req, rt.runShadow(req))
+	}()
+}
+
+func (rt *router) runShadow(req shadowRequest) shadowRecord {
+	rec := shadowRecord{
+		Time:    time.Now(),
+		Key:     req.key,
+		Primary: req.primary,
+		Shadow:  req.shadow,
+		Rows:    len(req.predictions),
+	}
+	loaded, err := rt.srv.Acquire(req.name, strconv.Itoa(req.shadow))
+	if err != nil {
+		rec.Error = err.Error()
+		return rec
+	}
+	defer loaded.Release()
+	model := loaded.Model
+	if req.raw {
+		model = model.EnsembleWithRawPredictions()
+	}
+	predictions, err := req.input.predict(model, loaded.Schema, req.nEstimators, req.threads)
+	if err != nil {
+		rec.Error = err.Error()
+		return rec
+	}
+	var sum float64
+	var n int
+	for i, row := range predictions {
+		if len(row) != len(req.predictions[i]) {
+			rec.Error = fmt.Sprintf("output groups differ: %d != %d", len(row), len(req.predictions[i]))
+			return rec
+		}
+		for j, v := range row {
+			d := math.Abs(v - req.predictions[i][j])
+			sum += d
+			n++
+			rec.MaxAbsDelta = math.Max(rec.MaxAbsDelta, d)
+		}
+	}
+	if n > 0 {
+		rec.MeanAbsDelta = sum / float64(n)
+	}
+	return rec
+}
+
+func (rt *router) record(req shadowRequest, rec shadowRecord) {
+	key := fmt.Sprintf("%s/%d/%d", req.name, rec.Primary, rec.Shadow)
+	rt.mu.Lock()
+	st, ok := rt.stats[key]
+	if !ok {
+		st = &shadowStats{Primary: rec.Primary, Shadow: rec.Shadow}
+		rt.stats[key] = st
+	}
+	st.Requests++
+	if rec.Error != "" {
+		st.Errors++
+	} else {
+		n := int64(rec.Rows) * int64(len(req.predictions[0]))
+		st.Rows += int64(rec.Rows)
+		st.values += n
+		st.sumAbsDelta += rec.MeanAbsDelta * float64(n)
+		st.MeanAbsDelta = st.sumAbsDelta / float64(st.values)
+		st.MaxAbsDelta = math.Max(st.MaxAbsDelta, rec.MaxAbsDelta)
+	}
+	rt.mu.Unlock()
+
+	data, _ := json.Marshal(rec)
+	if err := rt.writeShadowLog(req.name, append(data, '\n')); err != nil {
+		log.Printf("model %s: shadow log: %v", req.name, err)
+	}
+}
+
+// writeShadowLog 追加一条shadow记录，文件超过shadowLogMax时先轮转
+func (rt *router) writeShadowLog(name string, line []byte) error {
+	rt.logMu.Lock()
+	defer rt.logMu.Unlock()
+	path := filepath.Join(rt.reg.root, name, shadowLogFile)
+	if info, err := os.Stat(path); err == nil && info.Size()+int64(len(line)) > shadowLogMax {
+		if err := os.Rename(path, path+".1"); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (rt *router) setRoute(name string, route *Route) error {
+	if !validName.MatchString(name) {
+		return ErrInvalidName
+	}
+	total := 0.0
+	for _, s := range route.Split {
+		if s.Percent < 0 || s.Percent > 100 {
+			return routeError(fmt.Sprintf("split percent %v out of range", s.Percent))
+		}
+		total += s.Percent
+	}
+	if total > 100 {
+		return routeError(fmt.Sprintf("split percents sum to %v", total))
+	}
+	if route.Shadow != nil {
+		if route.Shadow.Percent < 0 || route.Shadow.Percent > 100 {
+			return routeError(fmt.Sprintf("shadow percent %v out of range", route.Shadow.Percent))
+		}
+	}
+	route.Updated = time.Now()
+	rt.setMu.Lock()
+	defer rt.setMu.Unlock()
+	if err := rt.reg.SetRoute(name, route); err != nil {
+		return err
+	}
+	rt.mu.Lock()
+	rt.routes[name] = route
+	rt.mu.Unlock()
+	return nil
+}
+
+func (rt *router) deleteRoute(name string) error {
+	if !validName.MatchString(name) {
+		return ErrInvalidName
+	}
+	rt.setMu.Lock()
+	defer rt.setMu.Unlock()
+	rt.mu.Lock()
+	delete(rt.routes, name)
+	rt.mu.Unlock()
+	err := os.Remove(filepath.Join(rt.reg.root, name, routeFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (rt *router) modelStats(name string) map[string]interface{} {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	pairs := make([]shadowStats, 0)
+	for key, st := range rt.stats {
+		if strings.HasPrefix(key, name+"/") {
+			pairs = append(pairs, *st)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].Primary != pairs[j].Primary {
+			return pairs[i].Primary < pairs[j].Primary
+		}
+		return pairs[i].Shadow < pairs[j].Shadow
+	})
+	return map[string]interface{}{
+		"name":    name,
+		"skipped": rt.skipped[name],
+		"shadow":  pairs,
+	}
+}
+
+func routesHandler(rt *router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := splitPath(strings.TrimPrefix(r.URL.Path, "/routes"))
+		switch {
+		case len(parts) == 2 && parts[1] == "stats" && r.Method == "GET":
+			writeJSON(w, http.StatusOK, rt.modelStats(parts[0]))
+		case len(parts) == 1 && r.Method == "GET":
+			rt.mu.RLock()
+			route := rt.routes[parts[0]]
+			rt.mu.RUnlock()
+			if route == nil {
+				http.Error(w, "no route for model", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, route)
+		case len(parts) == 1 && r.Method == "PUT":
+			route := &Route{}
+			if err := json.NewDecoder(r.Body).Decode(route); err != nil {
+				http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := rt.setRoute(parts[0], route); err != nil {
+				if _, ok := err.(routeError); ok {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+				} else {
+					writeError(w, err)
+				}
+				return
+			}
+			log.Printf("model %s: route updated", parts[0])
+			writeJSON(w, http.StatusOK, route)
+		case len(parts) == 1 && r.Method == "DELETE":
+			if err := rt.deleteRoute(parts[0]); err != nil {
+				writeError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+	}
+}
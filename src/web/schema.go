@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// 特征schema随模型一起上传，描述每一列特征的名字、类型、取值范围和缺失时的默认值，例如
+//	{"features": [
+//		{"name": "age", "type": "numeric", "min": 0, "max": 150},
+//		{"name": "income", "type": "numeric", "default": 0},
+//		{"name": "city", "type": "categorical", "categories": ["bj", "sh", "gz"]}
+//	]}
+// 有schema的模型可以用 {"instances": [{"age": 30, "city": "sh"}, ...]} 按特征名请求预测，
+// 缺少没有默认值的特征、未知的特征名或者取值不合法时返回具体是哪一行哪个特征出错
+
+const (
+	FeatureNumeric     = "numeric"
+	FeatureCategorical = "categorical"
+)
+
+type Feature struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Min        *float64 `json:"min,omitempty"`
+	Max        *float64 `json:"max,omitempty"`
+	Default    *float64 `json:"default,omitempty"`
+	Categories []string `json:"categories,omitempty"` // 类别特征取值的名字，下标即编码
+}
+
+type FeatureSchema struct {
+	Features []Feature `json:"features"`
+	index    map[string]int
+}
+
+// FeatureError 指出请求中出错的行和特征
+type FeatureError struct {
+	Row     int    `json:"row"`
+	Feature string `json:"feature,omitempty"`
+	Reason  string `json:"error"`
+}
+
+func (e *FeatureError) Error() string {
+	if e.Feature == "" {
+		return fmt.Sprintf("row %d: %s", e.Row, e.Reason)
+	}
+	return fmt.Sprintf("row %d: feature %q: %s", e.Row, e.Feature, e.Reason)
+}
+
+// SchemaError 表示schema本身不合法或者和模型对不上
+type SchemaError struct {
+	Reason string
+}
+
+func (e *SchemaError) Error() string {
+	return "invalid feature schema: " + e.Reason
+}
+
+func parseSchema(data []byte) (*FeatureSchema, error) {
+	s := &FeatureSchema{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, &SchemaError{err.Error()}
+	}
+	return s, nil
+}
+
+// check 检查schema是否合法，nFeatures 是模型的特征数
+func (s *FeatureSchema) check(nFeatures int) error {
+	if len(s.Features) != nFeatures {
+		return &SchemaError{fmt.Sprintf("schema has %d features, model expects %d", len(s.Features), nFeatures)}
+	}
+	s.index = make(map[string]int, len(s.Features))
+	for i := range s.Features {
+		f := &s.Features[i]
+		if f.Name == "" {
+			return &SchemaError{fmt.Sprintf("feature %d has no name", i)}
+		}
+		if _, ok := s.index[f.Name]; ok {
+			return &SchemaError{fmt.Sprintf("duplicate feature %q", f.Name)}
+		}
+		s.index[f.Name] = i
+		if f.Type == "" {
+			f.Type = FeatureNumeric
+		}
+		if f.Type != FeatureNumeric && f.Type != FeatureCategorical {
+			return &SchemaError{fmt.Sprintf("feature %q has unknown type %q", f.Name, f.Type)}
+		}
+		if f.Type == FeatureNumeric && len(f.Categories) > 0 {
+			return &SchemaError{fmt.Sprintf("numeric feature %q has categories", f.Name)}
+		}
+		if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+			return &SchemaError{fmt.Sprintf("feature %q has min > max", f.Name)}
+		}
+		if f.Default != nil {
+			if reason := f.check(*f.Default); reason != "" {
+				return &SchemaError{fmt.Sprintf("feature %q default: %s", f.Name, reason)}
+			}
+		}
+	}
+	return nil
+}
+
+// check 返回取值不合法的原因，合法时返回空串
+func (f *Feature) check(v float64) string {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return fmt.Sprintf("value %v is not a finite number", v)
+	}
+	if f.Min != nil && v < *f.Min {
+		return fmt.Sprintf("value %v is below minimum %v", v, *f.Min)
+	}
+	if f.Max != nil && v > *f.Max {
+		return fmt.Sprintf("value %v is above maximum %v", v, *f.Max)
+	}
+	if f.Type == FeatureCategorical {
+		if v != math.Trunc(v) || v < 0 {
+			return fmt.Sprintf("categorical value %v is not a non-negative integer", v)
+		}
+		if len(f.Categories) > 0 && int(v) >= len(f.Categories) {
+			return fmt.Sprintf("categorical value %v is not one of %d categories", v, len(f.Categories))
+		}
+	}
+	return ""
+}
+
+// value 把JSON中的取值转换成模型的输入，类别特征可以直接用类别名
+func (f *Feature) value(raw interface{}) (float64, string) {
+	switch v := raw.(type) {
+	case nil:
+		if f.Default == nil {
+			return 0, "missing value and no default"
+		}
+		return *f.Default, ""
+	case float64:
+		return v, f.check(v)
+	case string:
+		if f.Type != FeatureCategorical {
+			return 0, fmt.Sprintf("expected a number, got string %q", v)
+		}
+		for i, c := range f.Categories {
+			if c == v {
+				return float64(i), ""
+			}
+		}
+		return 0, fmt.Sprintf("unknown category %q", v)
+	default:
+		return 0, fmt.Sprintf("unsupported value %v", raw)
+	}
+}
+
+// Rows 把按特征名给出的样本转换成按schema顺序排列的稠密矩阵
+func (s *FeatureSchema) Rows(instances []map[string]interface{}) ([][]float64, error) {
+	rows := make([][]float64, len(instances))
+	for i, inst := range instances {
+		for name := range inst {
+			if _, ok := s.index[name]; !ok {
+				return nil, &FeatureError{Row: i, Feature: name, Reason: "unknown feature"}
+			}
+		}
+		row := make([]float64, len(s.Features))
+		for j := range s.Features {
+			f := &s.Features[j]
+			v, reason := f.value(inst[f.Name])
+			if reason != "" {
+				return nil, &FeatureError{Row: i, Feature: f.Name, Reason: reason}
+			}
+			row[j] = v
+		}
+		rows[i] = row
+	}
+	return rows, nil
+}
+
+// CheckRows 校验按位置给出的稠密样本
+func (s *FeatureSchema) CheckRows(rows [][]float64) error {
+	for i, row := range rows {
+		if len(row) != len(s.Features) {
+			return &FeatureError{Row: i, Reason: fmt.Sprintf("has %d values, schema has %d features", len(row), len(s.Features))}
+		}
+		for j, v := range row {
+			if reason := s.Features[j].check(v); reason != "" {
+				return &FeatureError{Row: i, Feature: s.Features[j].Name, Reason: reason}
+			}
+		}
+	}
+	return nil
+}
+
+// CheckCSR 校验CSR格式的样本，稀疏格式中没有出现的特征由模型按缺失值处理
+func (s *FeatureSchema) CheckCSR(indptr, cols []int, vals []float64) error {
+	for i := 0; i+1 < len(indptr); i++ {
+		for k := indptr[i]; k < indptr[i+1]; k++ {
+			if cols[k] >= len(s.Features) {
+				return &FeatureError{Row: i, Reason: fmt.Sprintf("column %d out of range, schema has %d features", cols[k], len(s.Features))}
+			}
+			f := &s.Features[cols[k]]
+			if reason := f.check(vals[k]); reason != "" {
+				return &FeatureError{Row: i, Feature: f.Name, Reason: reason}
+			}
+		}
+	}
+	return nil
+}
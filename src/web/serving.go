@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dmitryikh/leaves"
+)
+
+// loadedModel 是加载到内存中的一个模型版本，通过引用计数管理生命周期。
+// modelServer 自己持有一个引用，每个正在处理的请求各持有一个引用，
+// 计数降到0时才释放模型，所以切换版本时正在进行的请求仍然使用旧模型完成
+type loadedModel struct {
+	Name    string
+	Version int
+	Model   *leaves.Ensemble
+	Schema  *FeatureSchema // 没有schema时为nil
+	refs    int64
+}
+
+func newLoadedModel(name string, version int, model *leaves.Ensemble, schema *FeatureSchema) *loadedModel {
+	return &loadedModel{Name: name, Version: version, Model: model, Schema: schema, refs: 1}
+}
+
+// tryAcquire 只有在模型还没被释放时才增加引用计数
+func (m *loadedModel) tryAcquire() bool {
+	for {
+		n := atomic.LoadInt64(&m.refs)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&m.refs, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (m *loadedModel) Release() {
+	if atomic.AddInt64(&m.refs, -1) == 0 {
+		log.Printf("model %s: released version %d", m.Name, m.Version)
+		m.Model = nil
+		m.Schema = nil
+	}
+}
+
+// modelServer 管理对外服务的模型。每个模型名对应一个atomic.Value，保存当前版本的
+// *loadedModel，上传或promote新版本时先在锁外加载好新模型，再原子地替换指针
+type modelServer struct {
+	reg     *Registry
+	mu      sync.Mutex
+	current map[string]*atomic.Value // name -> *loadedModel
+	pinned  map[string]*pinnedModel  // "name/version" -> 显式指定版本号请求的非当前版本
+	loading map[string]*sync.Mutex   // 同一个模型名的加载和切换串行进行
+}
+
+// pinnedModel 记录非当前版本最后一次被请求的时间，长时间没有请求时由ReleaseIdle释放
+type pinnedModel struct {
+	*loadedModel
+	used time.Time
+}
+
+func newModelServer(reg *Registry) *modelServer {
+	return &modelServer{
+		reg:     reg,
+		current: make(map[string]*atomic.Value),
+		pinned:  make(map[string]*pinnedModel),
+		loading: make(map[string]*sync.Mutex),
+	}
+}
+
+// Acquire 返回模型的一个引用，调用方用完之后必须调用Release。
+// version 可以是版本号、current、latest或空串(等同于current)
+func (s *modelServer) Acquire(name, version string) (*loadedModel, error) {
+	if version == "" || version == "current" {
+		return s.acquireCurrent(name)
+	}
+	v, err := s.reg.Resolve(name, version)
+	if err != nil {
+		return nil, err
+	}
+	if m, err := s.acquireCurrent(name); err == nil {
+		if m.Version == v {
+			return m, nil
+		}
+		m.Release()
+	}
+	return s.acquirePinned(name, v)
+}
+
+func (s *modelServer) acquireCurrent(name string) (*loadedModel, error) {
+	slot, err := s.slot(name)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		// 替换和最后一次Release可能发生在Load和tryAcquire之间，失败时重新读取指针
+		if m := slot.Load().(*loadedModel); m.tryAcquire() {
+			return m, nil
+		}
+	}
+}
+
+// slot 返回模型名对应的atomic.Value，第一次访问时加载registry中的当前版本
+func (s *modelServer) slot(name string) (*atomic.Value, error) {
+	s.mu.Lock()
+	slot, ok := s.current[name]
+	s.mu.Unlock()
+	if ok {
+		return slot, nil
+	}
+	// 先确认模型存在，loading中只会有registry里的模型名
+	if !validName.MatchString(name) {
+		return nil, ErrInvalidName
+	}
+	if _, err := s.reg.Current(name); err != nil {
+		return nil, err
+	}
+
+	l := s.lockName(name)
+	defer l.Unlock()
+	s.mu.Lock()
+	slot, ok = s.current[name]
+	s.mu.Unlock()
+	if ok {
+		return slot, nil
+	}
+	v, err := s.reg.Current(name)
+	if err != nil {
+		return nil, err
+	}
+	m, err := s.load(name, v)
+	if err != nil {
+		return nil, err
+	}
+	slot = &atomic.Value{}
+	slot.Store(m)
+	s.mu.Lock()
+	s.current[name] = slot
+	s.mu.Unlock()
+	return slot, nil
+}
+
+func (s *modelServer) acquirePinned(name string, version int) (*loadedModel, error) {
+	key := name + "/" + strconv.Itoa(version)
+	if m := s.acquireLoaded(key); m != nil {
+		return m, nil
+	}
+
+	l := s.lockName(name)
+	defer l.Unlock()
+	if m := s.acquireLoaded(key); m != nil {
+		return m, nil
+	}
+	m, err := s.load(name, version)
+	if err != nil {
+		return nil, err
+	}
+	m.tryAcquire()
+	s.mu.Lock()
+	s.pinned[key] = &pinnedModel{m, time.Now()}
+	s.mu.Unlock()
+	return m, nil
+}
+
+// acquireLoaded 返回已经加载的非当前版本的一个引用并更新它的使用时间，没有加载时返回nil
+func (s *modelServer) acquireLoaded(key string) *loadedModel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pinned[key]
+	if !ok || !p.tryAcquire() {
+		return nil
+	}
+	p.used = time.Now()
+	return p.loadedModel
+}
+
+// Swap 把模型的当前版本替换为version。模型还没有被加载过时什么都不做，
+// 下一次请求会直接加载registry中的当前版本
+func (s *modelServer) Swap(name string, version int) error {
+	l := s.lockName(name)
+	defer l.Unlock()
+	s.mu.Lock()
+	slot, ok := s.current[name]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	old := slot.Load().(*loadedModel)
+	if old.Version == version {
+		return nil
+	}
+
+	key := name + "/" + strconv.Itoa(version)
+	s.mu.Lock()
+	p, ok := s.pinned[key]
+	delete(s.pinned, key)
+	s.mu.Unlock()
+	var m *loadedModel
+	if ok {
+		m = p.loadedModel
+	} else {
+		var err error
+		if m, err = s.load(name, version); err != nil {
+			return err
+		}
+	}
+	slot.Store(m)
+	log.Printf("model %s: serving version %d (was %d)", name, version, old.Version)
+	old.Release()
+	return nil
+}
+
+// Evict 释放已删除版本占用的内存
+func (s *modelServer) Evict(name string, version int) {
+	key := name + "/" + strconv.Itoa(version)
+	s.mu.Lock()
+	p, ok := s.pinned[key]
+	delete(s.pinned, key)
+	s.mu.Unlock()
+	if ok {
+		p.Release()
+	}
+}
+
+// ReleaseIdle 定期释放超过idle没有被请求的非当前版本，之后再请求时重新加载
+func (s *modelServer) ReleaseIdle(ctx context.Context, idle time.Duration) {
+	ticker := time.NewTicker(idle / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		var idles []*pinnedModel
+		s.mu.Lock()
+		for key, p := range s.pinned {
+			if time.Since(p.used) > idle {
+				delete(s.pinned, key)
+				idles = append(idles, p)
+			}
+		}
+		s.mu.Unlock()
+		// 正在处理的请求仍然持有引用，它们结束以后模型才真正被释放
+		for _, p := range idles {
+			log.Printf("model %s: version %d idle for %v", p.Name, p.Version, idle)
+			p.Release()
+		}
+	}
+}
+
+// Watch 定期检查registry中的CURRENT，发现被其它进程修改后切换到新版本
+func (s *modelServer) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		s.mu.Lock()
+		names := make([]string, 0, len(s.current))
+		for name := range s.current {
+			names = append(names, name)
+		}
+		s.mu.Unlock()
+		for _, name := range names {
+			v, err := s.reg.Current(name)
+			if err != nil {
+				log.Printf("model %s: %v", name, err)
+				continue
+			}
+			if err := s.Swap(name, v); err != nil {
+				log.Printf("model %s: reload version %d: %v", name, v, err)
+			}
+		}
+	}
+}
+
+func (s *modelServer) load(name string, version int) (*loadedModel, error) {
+	model, _, err := s.reg.Load(name, version)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := s.reg.Schema(name, version)
+	if err != nil {
+		return nil, err
+	}
+	if schema != nil {
+		if err := schema.check(model.NFeatures()); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("model %s: loaded version %d", name, version)
+	return newLoadedModel(name, version, model, schema), nil
+}
+
+func (s *modelServer) lockName(name string) *sync.Mutex {
+	s.mu.Lock()
+	l, ok := s.loading[name]
+	if !ok {
+		l = &sync.Mutex{}
+		s.loading[name] = l
+	}
+	s.mu.Unlock()
+	l.Lock()
+	return l
+}
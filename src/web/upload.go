@@ -4,65 +4,348 @@
 package main
 
 import (
-	"crypto/md5"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
-	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
-	"os"
-	"strconv"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 	"time"
+
+	"go-practice/src/lifecycle"
 )
 
+func login(w http.ResponseWriter, r *http.Request) {
 
+	t, err := template.ParseFiles("pages/upload.gtpl")
+	if err != nil {
+		fmt.Printf(err.Error())
+	}
+	log.Println(t.Execute(w, nil))
+}
 
+var (
+	addr      = flag.String("addr", ":9090", "listen address")
+	modelDir  = flag.String("models", "model", "model registry directory")
+	nThreads  = flag.Int("threads", 1, "default number of threads used by predict")
+	reload    = flag.Duration("reload", 10*time.Second, "interval to check the registry for promoted versions, 0 to disable")
+	pinIdle   = flag.Duration("pinned-idle", 10*time.Minute, "release non-current versions requested by number after this long without requests, 0 to keep them")
+	maxUpload = flag.Int64("max-upload", 1<<30, "maximum model size in bytes")
+	shadowers = flag.Int("shadow-workers", 4, "maximum concurrent shadow predictions")
+	drain     = flag.Duration("drain", 10*time.Second, "time to wait for in-flight requests on shutdown")
 
-func login(w http.ResponseWriter, r *http.Request) {
+	metricsFile     = flag.String("metrics-file", "", "append prediction metrics in line protocol to this file")
+	influxURL       = flag.String("influx-url", "", "InfluxDB v2 base url for prediction metrics, e.g. http://localhost:8086")
+	influxOrg       = flag.String("influx-org", "", "InfluxDB organization")
+	influxBucket    = flag.String("influx-bucket", "predictions", "InfluxDB bucket")
+	influxToken     = flag.String("influx-token", "", "InfluxDB API token")
+	metricsBatch    = flag.Int("metrics-batch", 500, "points per metrics write")
+	metricsInterval = flag.Duration("metrics-interval", 5*time.Second, "maximum delay before buffered metrics are written")
 
-		t, err := template.ParseFiles("pages/upload.gtpl")
-		if err != nil {
-			fmt.Printf(err.Error())
-		}
-		log.Println(t.Execute(w, nil))
-}
+	registry *Registry
+	tokens   = newTokenStore(time.Hour)
+	serving  *modelServer
+)
 
 func main() {
+	flag.Parse()
+	var err error
+	registry, err = NewRegistry(*modelDir)
+	if err != nil {
+		log.Fatal(err)
+	}
 	http.HandleFunc("/file", login) //设置访问的路由
 	http.HandleFunc("/upload", upload)
 	// 处理/upload 逻辑
-	err := http.ListenAndServe(":9090", nil) //设置监听的端口
+	chunks, err := newChunkStore(filepath.Join(*modelDir, ".chunks"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	http.HandleFunc("/upload/chunked", chunkedUpload(chunks))
+	http.HandleFunc("/upload/chunked/", chunkedUpload(chunks))
+	serving = newModelServer(registry)
+	lc := lifecycle.New(*drain)
+	if *reload > 0 {
+		go serving.Watch(lc.Context(), *reload)
+	}
+	if *pinIdle > 0 {
+		go serving.ReleaseIdle(lc.Context(), *pinIdle)
+	}
+	go tokens.Expire(lc.Context(), time.Minute)
+	http.HandleFunc("/models", modelsHandler(registry, serving))
+	http.HandleFunc("/models/", modelsHandler(registry, serving))
+	rt, err := newRouter(registry, serving, *shadowers)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		log.Fatal(err)
+	}
+	http.HandleFunc("/routes/", routesHandler(rt))
+	var stats *metrics
+	switch {
+	case *influxURL != "":
+		stats = newMetrics(newInfluxSink(*influxURL, *influxOrg, *influxBucket, *influxToken), *metricsBatch, *metricsInterval)
+	case *metricsFile != "":
+		stats = newMetrics(&fileSink{path: *metricsFile}, *metricsBatch, *metricsInterval)
+	}
+	defer stats.Close()
+	http.HandleFunc("/predict/", predictHandler(serving, rt, stats, *nThreads))
+	lc.RegisterHealth(http.DefaultServeMux)
+	// 退出时先等处理中的请求结束，再由defer写出剩余的metrics
+	if err := lc.ListenAndServe(&http.Server{Addr: *addr}); err != nil { //设置监听的端口
+		log.Print("ListenAndServe: ", err)
 	}
 }
 
+// upload 的一次性token(GET /upload 时下发)放在 X-Upload-Token 请求头或者查询参数token中，
+// 在读取body之前校验。POST表单字段:
+//
+//	uploadfile 模型文件
+//	format     模型格式
+//	name       模型名，默认取文件名去掉扩展名
+//	sha256     可选，文件内容的SHA-256，不一致时拒绝保存
+//	promote    是否切换为当前版本，默认true
+//	uploader   可选，上传者，缺省取 X-Uploader 请求头或客户端地址
+//	schema     可选，特征schema的JSON文本，也可以用文件字段 schemafile 上传
 func upload(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("method:", r.Method) //获取请求的方法
-	if r.Method == "GET" {
-		crutime := time.Now().Unix()
-		h := md5.New()
-		io.WriteString(h, strconv.FormatInt(crutime, 10))
-		token := fmt.Sprintf("%x", h.Sum(nil))
-		t, _ := template.ParseFiles("pages/upload.gtpl")
-		t.Execute(w, token)
-	} else {
-		r.ParseMultipartForm(32 << 20)
+	switch r.Method {
+	case "GET":
+		token, err := tokens.New(clientHost(r))
+		if err == errTooManyTokens {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		t, err := template.ParseFiles("pages/upload.gtpl")
+		if err != nil {
+			// 没有页面模板时直接以JSON返回token，方便脚本调用
+			writeJSON(w, http.StatusOK, map[string]string{"token": token})
+			return
+		}
+		if err := t.Execute(w, token); err != nil {
+			log.Println(err)
+		}
+	case "POST":
+		// 没有有效token的请求不会让ParseMultipartForm把上传的数据写到磁盘
+		if !tokens.Consume(requestToken(r)) {
+			http.Error(w, "invalid or expired upload token", http.StatusForbidden)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, *maxUpload)
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			if isTooLarge(err) {
+				http.Error(w, fmt.Sprintf("upload exceeds %d bytes", *maxUpload), http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
 		file, handler, err := r.FormFile("uploadfile")
 		if err != nil {
-			fmt.Println(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		defer file.Close()
-		fmt.Fprintf(w, "%v", handler.Header)
-		f, err := os.Create("model/"+handler.Filename)
+		filename := sanitizeFilename(handler.Filename)
+		name := r.FormValue("name")
+		if name == "" {
+			name = strings.TrimSuffix(filename, filepath.Ext(filename))
+		}
+		uploader := r.FormValue("uploader")
+		if uploader == "" {
+			uploader = uploaderOf(r)
+		}
+		schema, err := formSchema(r)
 		if err != nil {
-			fmt.Println(err)
+			writeError(w, err)
 			return
 		}
-		defer f.Close()
-		io.Copy(f, file)
+		mv, err := registry.Save(ModelVersion{
+			Name:     name,
+			Format:   r.FormValue("format"),
+			Filename: filename,
+			SHA256:   r.FormValue("sha256"),
+			Uploader: uploader,
+		}, schema, file)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		publish(w, mv, r.FormValue("promote") != "false")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
+// publish 记录上传成功的版本，默认新上传的版本直接成为当前版本，promote=false 时只保存不切换
+func publish(w http.ResponseWriter, mv *ModelVersion, promote bool) {
+	log.Printf("model %s: uploaded version %d (%s, %d bytes, sha256 %s)", mv.Name, mv.Version, mv.Format, mv.Size, mv.SHA256)
+	if promote {
+		if err := registry.Promote(mv.Name, mv.Version); err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := serving.Swap(mv.Name, mv.Version); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusCreated, mv)
+}
 
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// sanitizeFilename 只保留文件名中的安全字符，去掉目录部分和开头的"."等字符，
+// 防止形如 "../../etc/passwd" 的文件名造成路径穿越
+func sanitizeFilename(name string) string {
+	name = filepath.Base(strings.Replace(name, "\\", "/", -1))
+	name = unsafeChars.ReplaceAllString(name, "_")
+	name = strings.TrimLeft(name, "._-")
+	if len(name) > 64 {
+		name = name[len(name)-64:]
+		name = strings.TrimLeft(name, "._-")
+	}
+	if name == "" {
+		name = "model"
+	}
+	return name
+}
+
+// formSchema 从表单字段schema或文件字段schemafile中读取特征schema，都没有时返回nil
+func formSchema(r *http.Request) (*FeatureSchema, error) {
+	if s := r.FormValue("schema"); s != "" {
+		return parseSchema([]byte(s))
+	}
+	file, _, err := r.FormFile("schemafile")
+	if err == http.ErrMissingFile {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return parseSchema(data)
+}
+
+// uploaderOf 在请求没有显式给出上传者时，用 X-Uploader 请求头或客户端地址代替
+func uploaderOf(r *http.Request) string {
+	if u := r.Header.Get("X-Uploader"); u != "" {
+		return u
+	}
+	return clientHost(r)
+}
+
+// clientHost 返回客户端的IP
+func clientHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// requestToken 从请求头或查询参数中取上传token，不读取body
+func requestToken(r *http.Request) string {
+	if t := r.Header.Get("X-Upload-Token"); t != "" {
+		return t
+	}
+	return r.URL.Query().Get("token")
+}
+
+func isTooLarge(err error) bool {
+	return errors.As(err, new(*http.MaxBytesError))
+}
+
+const (
+	maxTokens        = 4096 // 同时有效的token总数
+	maxTokensPerHost = 16   // 每个客户端同时持有的token数
+)
+
+var errTooManyTokens = errors.New("too many unused upload tokens, use or let some expire first")
+
+// tokenStore 保存下发给上传页面的一次性token，用于防止CSRF。
+// 每个客户端和总共持有的token数都有上限，过期的token由Expire定期删除
+type tokenStore struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	tokens map[string]issuedToken
+	byHost map[string]int // 客户端IP -> 未使用的token数
+}
+
+type issuedToken struct {
+	host   string
+	expire time.Time
+}
+
+func newTokenStore(ttl time.Duration) *tokenStore {
+	return &tokenStore{ttl: ttl, tokens: make(map[string]issuedToken), byHost: make(map[string]int)}
+}
+
+// New 给host下发一个token，超过上限时返回errTooManyTokens
+func (s *tokenStore) New(host string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.tokens) >= maxTokens || s.byHost[host] >= maxTokensPerHost {
+		return "", errTooManyTokens
+	}
+	s.tokens[token] = issuedToken{host: host, expire: time.Now().Add(s.ttl)}
+	s.byHost[host]++
+	return token, nil
+}
+
+// Consume 校验token并使其失效，每个token只能使用一次
+func (s *tokenStore) Consume(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[token]
+	if !ok {
+		return false
+	}
+	s.remove(token, t)
+	return time.Now().Before(t.expire)
+}
+
+// Expire 定期删除过期的token，直到ctx被取消
+func (s *tokenStore) Expire(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for token, t := range s.tokens {
+				if now.After(t.expire) {
+					s.remove(token, t)
+				}
+			}
+			s.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// remove 删除token，调用时持有s.mu
+func (s *tokenStore) remove(token string, t issuedToken) {
+	delete(s.tokens, token)
+	if s.byHost[t.host]--; s.byHost[t.host] <= 0 {
+		delete(s.byHost, t.host)
+	}
+}